@@ -2,15 +2,29 @@ package main
 
 import (
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/cryptohelpers"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/grpcapi"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
 	"github.com/go-resty/resty/v2"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestSendMetricJSON(t *testing.T) {
@@ -88,7 +102,7 @@ func TestSendMetricJSON(t *testing.T) {
 		Client:    client,
 		ServerURL: ts.URL,
 	}
-	err := agent.sendMetricJSON(expectedMetric)
+	err := agent.sendMetricJSON(context.Background(), expectedMetric)
 
 	// Проверяем, что ошибок не было
 	assert.NoError(t, err)
@@ -108,3 +122,378 @@ func TestCollectRuntimeMetrics(t *testing.T) {
 	assert.LessOrEqual(t, agent.RandomValue, 1.0)
 	assert.GreaterOrEqual(t, agent.Metrics["NumGC"], 0.0)
 }
+
+// Воркеры разбирают очередь до закрытия канала, даже если сбор метрик уже остановлен
+func TestWorkersDrainQueueOnShutdown(t *testing.T) {
+	var received atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	agent := NewAgent(ts.URL)
+	agent.collectMetrics()
+
+	jobs := make(chan models.Metrics, 128)
+	workers := startWorkers(context.Background(), 2, jobs, agent)
+
+	// финальный отчёт после остановки продюсеров
+	assert.True(t, agent.enqueueReport(context.Background(), jobs))
+	close(jobs)
+	workers.Wait()
+
+	// все gauge из runtime + RandomValue + PollCount
+	assert.Equal(t, int64(len(agent.Metrics)+2), received.Load())
+}
+
+// По дедлайну остановки отправка прерывается и воркеры завершаются
+func TestWorkersStopOnDeadline(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable) // сервер недоступен — агент уходит в ретраи
+	}))
+	defer ts.Close()
+
+	agent := NewAgent(ts.URL)
+	jobs := make(chan models.Metrics, 8)
+	v := 1.0
+	jobs <- models.Metrics{ID: "Alloc", MType: "gauge", Value: &v}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	workers := startWorkers(ctx, 1, jobs, agent)
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("workers did not stop after deadline")
+	}
+}
+
+// Batcher подписывает пакет, отправляет остаток при закрытии очереди и не превышает лимит параллельных отправок
+func TestBatcherSignsAndFlushesOnClose(t *testing.T) {
+	const key = "secret"
+	var (
+		received atomic.Int64
+		active   atomic.Int64
+		maxSeen  atomic.Int64
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/updates", r.URL.Path)
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			m := maxSeen.Load()
+			if n <= m || maxSeen.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		gr, err := gzip.NewReader(r.Body)
+		assert.NoError(t, err)
+		body, err := io.ReadAll(gr)
+		assert.NoError(t, err)
+		assert.True(t, cryptohelpers.Compare(body, key, r.Header.Get("HashSHA256")))
+
+		var batch []models.Metrics
+		assert.NoError(t, json.Unmarshal(body, &batch))
+		received.Add(int64(len(batch)))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	in := make(chan models.Metrics, 64)
+	for i := 0; i < 25; i++ {
+		v := float64(i)
+		in <- models.Metrics{ID: fmt.Sprintf("G%d", i), MType: "gauge", Value: &v}
+	}
+	close(in)
+
+	// пакеты по 4 метрики, не больше 2 отправок одновременно, таймер не успеет сработать
+	b := NewBatcher(ts.URL+"/updates", time.Hour, 4, key, 2)
+	b.Run(context.Background(), in)
+
+	assert.Equal(t, int64(25), received.Load())
+	assert.LessOrEqual(t, maxSeen.Load(), int64(2))
+}
+
+func TestOutboxDedupesAndPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	gauge := func(id string, v float64) models.Metrics { return models.Metrics{ID: id, MType: "gauge", Value: &v} }
+	counter := func(id string, d int64) models.Metrics { return models.Metrics{ID: id, MType: "counter", Delta: &d} }
+
+	o, err := NewOutbox(path, 100)
+	require.NoError(t, err)
+	assert.False(t, o.Active())
+
+	require.NoError(t, o.Put(gauge("Alloc", 1), counter("PollCount", 2), gauge("Sys", 5)))
+	require.NoError(t, o.Put(gauge("Alloc", 3), counter("PollCount", 4)))
+	assert.True(t, o.Active())
+	// второй Put сразу после первого файл не переписывает — изменения сохраняет Flush
+	require.NoError(t, o.Flush())
+
+	// после перезапуска агента очередь восстанавливается из файла
+	o, err = NewOutbox(path, 100)
+	require.NoError(t, err)
+
+	ms := o.Drain()
+	require.Len(t, ms, 3)
+	assert.Equal(t, "Alloc", ms[0].ID)
+	assert.Equal(t, 3.0, *ms[0].Value)
+	assert.Equal(t, "PollCount", ms[1].ID)
+	assert.Equal(t, int64(6), *ms[1].Delta)
+	assert.Equal(t, "Sys", ms[2].ID)
+	assert.True(t, o.Active(), "outbox stays active while replay is in flight")
+
+	// пока идёт досылка, пришли новые значения
+	require.NoError(t, o.Put(gauge("Alloc", 7), counter("PollCount", 1)))
+
+	// отправить не удалось ничего: старые метрики возвращаются в начало очереди
+	require.NoError(t, o.Done(ms))
+	ms = o.Drain()
+	require.Len(t, ms, 3)
+	assert.Equal(t, 7.0, *ms[0].Value, "newer gauge wins")
+	assert.Equal(t, int64(7), *ms[1].Delta, "counter deltas are summed")
+
+	// всё отправлено — файл очереди удалён
+	require.NoError(t, o.Done(nil))
+	assert.False(t, o.Active())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestOutboxCapEvictsOldestGauges(t *testing.T) {
+	o, err := NewOutbox(filepath.Join(t.TempDir(), "outbox.json"), 2)
+	require.NoError(t, err)
+
+	g1, g2, d := 1.0, 2.0, int64(1)
+	require.NoError(t, o.Put(
+		models.Metrics{ID: "PollCount", MType: "counter", Delta: &d},
+		models.Metrics{ID: "G1", MType: "gauge", Value: &g1},
+		models.Metrics{ID: "G2", MType: "gauge", Value: &g2},
+	))
+
+	ms := o.Drain()
+	require.Len(t, ms, 2)
+	assert.Equal(t, "PollCount", ms[0].ID)
+	assert.Equal(t, "G2", ms[1].ID)
+}
+
+// Пока сервер недоступен, воркер откладывает метрику в очередь на диске; отвергнутую сервером — отбрасывает
+func TestWorkerOutboxesOnlyTemporaryFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		queued bool
+	}{
+		{name: "bad request is dropped", status: http.StatusBadRequest, queued: false},
+		{name: "unavailable is queued", status: http.StatusServiceUnavailable, queued: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer ts.Close()
+
+			outbox, err := NewOutbox(filepath.Join(t.TempDir(), "outbox.json"), 100)
+			require.NoError(t, err)
+			agent := NewAgent(ts.URL)
+			agent.Outbox = outbox
+
+			jobs := make(chan models.Metrics, 2)
+			v := 1.0
+			jobs <- models.Metrics{ID: "Alloc", MType: "gauge", Value: &v}
+			close(jobs)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			startWorkers(ctx, 1, jobs, agent).Wait()
+
+			assert.Equal(t, tt.queued, outbox.Active())
+		})
+	}
+}
+
+// Досылка очереди пропускает метрику, которую сервер отвергает, и доставляет остальные
+func TestReplayDropsRejectedMetrics(t *testing.T) {
+	var delivered atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(gr)
+		require.NoError(t, err)
+		if strings.Contains(string(body), `"Bad"`) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delivered.Add(int64(strings.Count(string(body), `"id"`)))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	v := 1.0
+	ms := []models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &v},
+		{ID: "Bad", MType: "gauge", Value: &v},
+		{ID: "Sys", MType: "gauge", Value: &v},
+	}
+
+	t.Run("one by one", func(t *testing.T) {
+		delivered.Store(0)
+		assert.Empty(t, NewAgent(ts.URL).deliver(context.Background(), ms))
+		assert.Equal(t, int64(2), delivered.Load())
+	})
+	t.Run("batch", func(t *testing.T) {
+		delivered.Store(0)
+		b := NewBatcher(ts.URL+"/updates", time.Hour, 10, "", 1)
+		assert.Empty(t, b.deliver(context.Background(), ms))
+		assert.Equal(t, int64(2), delivered.Load())
+	})
+}
+
+// testCollector отдаёт gauge с меткой и counter с приростом 2 за вызов
+type testCollector struct{}
+
+func (testCollector) Name() string { return "test" }
+
+func (testCollector) Collect(context.Context) ([]models.Metrics, error) {
+	g := gaugeMetric("Temp", 36.6)
+	g.Labels = models.Labels{"sensor": "a"}
+	d := int64(2)
+	return []models.Metrics{g, {ID: "Ticks", MType: models.Counter, Delta: &d}}, nil
+}
+
+func TestCollectorRegistry(t *testing.T) {
+	RegisterCollector("test", time.Minute, false, func(*Agent) Collector { return testCollector{} })
+	t.Cleanup(func() { delete(collectorRegistry, "test") })
+
+	configs, err := parseCollectors("", 2*time.Second)
+	require.NoError(t, err)
+	names := make([]string, 0, len(configs))
+	for _, c := range configs {
+		names = append(names, c.name)
+	}
+	assert.Equal(t, []string{"disk", "load", "net", "process", "runtime", "swap", "sys", "uptime"}, names, "test выключен по умолчанию")
+
+	configs, err = parseCollectors("test:30s,-sys,-disk,-net,-load,-swap,-uptime,-process", 2*time.Second)
+	require.NoError(t, err)
+	require.Len(t, configs, 2)
+	assert.Equal(t, "runtime", configs[0].name)
+	assert.Equal(t, 2*time.Second, configs[0].interval, "runtime по умолчанию опрашивается с -p")
+	assert.Equal(t, "test", configs[1].name)
+	assert.Equal(t, 30*time.Second, configs[1].interval)
+
+	_, err = parseCollectors("gpu", time.Second)
+	assert.Error(t, err)
+	_, err = parseCollectors("test:0s", time.Second)
+	assert.Error(t, err)
+
+	agent := NewAgent("http://localhost")
+	c := configs[1].factory(agent)
+	require.NoError(t, agent.collect(context.Background(), c))
+	require.NoError(t, agent.collect(context.Background(), c))
+
+	jobs := make(chan models.Metrics, 8)
+	require.True(t, agent.enqueueReport(context.Background(), jobs))
+	close(jobs)
+	got := map[string]models.Metrics{}
+	for m := range jobs {
+		got[m.ID] = m
+	}
+	require.Contains(t, got, "Temp")
+	assert.Equal(t, models.Labels{"sensor": "a"}, got["Temp"].Labels)
+	assert.Equal(t, 36.6, *got["Temp"].Value)
+	require.Contains(t, got, "Ticks")
+	assert.Equal(t, int64(4), *got["Ticks"].Delta)
+
+	// прирост counter отправлен и обнулён
+	assert.Empty(t, agent.Counters)
+}
+
+func TestDeltaTracker(t *testing.T) {
+	tr := deltaTracker{}
+	labels := models.Labels{"iface": "eth0"}
+
+	_, ok := tr.counter("NetBytesSent", labels, 100)
+	assert.False(t, ok, "первое значение только запоминается")
+
+	m, ok := tr.counter("NetBytesSent", labels, 150)
+	require.True(t, ok)
+	assert.Equal(t, int64(50), *m.Delta)
+	assert.Equal(t, labels, m.Labels)
+
+	// счётчик сбросился (перезагрузка, переполнение) — прирост считается от нуля
+	m, ok = tr.counter("NetBytesSent", labels, 20)
+	require.True(t, ok)
+	assert.Equal(t, int64(20), *m.Delta)
+}
+
+// Системные группы метрик собираются на текущей ОС
+func TestSystemCollectors(t *testing.T) {
+	agent := NewAgent("http://localhost")
+	for _, name := range []string{"load", "uptime", "process"} {
+		c := collectorRegistry[name].factory(agent)
+		ms, err := c.Collect(context.Background())
+		require.NoError(t, err, name)
+		assert.NotEmpty(t, ms, name)
+	}
+}
+
+// Агент отправляет метрики через gRPC: поштучно воркерами и пакетом через Batcher, с подписью HMAC
+func TestGRPCTransport(t *testing.T) {
+	storage := repository.NewMemStorage()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpcapi.NewGRPCServer(storage, "secret")
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Stop()
+
+	tr, err := newGRPCTransport(ln.Addr().String(), "secret")
+	require.NoError(t, err)
+	defer tr.Close()
+
+	agent := NewAgent("http://unused")
+	agent.Transport = tr
+
+	jobs := make(chan models.Metrics, 2)
+	v, d := 1.5, int64(2)
+	jobs <- models.Metrics{ID: "Alloc", MType: "gauge", Value: &v}
+	jobs <- models.Metrics{ID: "PollCount", MType: "counter", Delta: &d}
+	close(jobs)
+	startWorkers(context.Background(), 2, jobs, agent).Wait()
+
+	b := NewBatcher("http://unused/updates", time.Second, 100, "secret", 1)
+	b.transport = tr
+	batch := make([]models.Metrics, 0, grpcBatchChunk+1)
+	for i := 0; i < grpcBatchChunk+1; i++ {
+		g := float64(i)
+		batch = append(batch, models.Metrics{ID: fmt.Sprintf("G%d", i), MType: "gauge", Value: &g})
+	}
+	require.NoError(t, b.Send(context.Background(), batch))
+
+	ctx := context.Background()
+	alloc, err := storage.GetGauge(ctx, "Alloc")
+	assert.NoError(t, err)
+	assert.Equal(t, 1.5, alloc)
+	pc, _ := storage.GetCounter(ctx, "PollCount")
+	assert.Equal(t, int64(2), pc)
+	last, err := storage.GetGauge(ctx, fmt.Sprintf("G%d", grpcBatchChunk))
+	assert.NoError(t, err)
+	assert.Equal(t, float64(grpcBatchChunk), last)
+
+	// слишком большой пакет не ретраится, а отклоняется — Batcher разобьёт его
+	tooLarge := status.Error(codes.ResourceExhausted, "batch is too large")
+	assert.False(t, grpcRetriable(tooLarge))
+	assert.ErrorIs(t, grpcRejected(tooLarge), errRejected)
+	assert.NotErrorIs(t, grpcRejected(status.Error(codes.Unavailable, "down")), errRejected)
+}
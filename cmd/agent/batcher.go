@@ -5,9 +5,10 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
-	"net/http"
+	"sync"
 	"time"
 
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/cryptohelpers"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
 	"github.com/go-resty/resty/v2"
@@ -16,43 +17,46 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net"
 
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/retry"
 )
 
+// Batcher копит метрики и отправляет их пакетами на /updates:
+// по достижении maxSize или раз в flushInt, не больше rateLimit отправок одновременно.
 type Batcher struct {
-	in       chan models.Metrics
-	flushInt time.Duration
-	maxSize  int
-	client   *resty.Client
-	endpoint string
+	flushInt  time.Duration
+	maxSize   int
+	client    *resty.Client
+	endpoint  string
+	key       string        // ключ HMAC для заголовка HashSHA256
+	sem       chan struct{} // ограничение параллельных отправок (-l)
+	inflight  sync.WaitGroup
+	outbox    *Outbox   // очередь на диске для неотправленных пакетов (nil — выключена)
+	transport Transport // отправка пакета не по HTTP (nil — HTTP на endpoint)
 }
 
-func NewBatcher(endpoint string, flushInt time.Duration, maxSize int) *Batcher {
+func NewBatcher(endpoint string, flushInt time.Duration, maxSize int, key string, rateLimit int) *Batcher {
+	if rateLimit < 1 {
+		rateLimit = 1
+	}
 	c := resty.New().
 		SetHeader("Content-Type", "application/json")
 	return &Batcher{
-		in:       make(chan models.Metrics, 1024),
 		flushInt: flushInt,
 		maxSize:  maxSize,
 		client:   c,
 		endpoint: endpoint,
+		key:      key,
+		sem:      make(chan struct{}, rateLimit),
 	}
 }
 
-func (b *Batcher) Add(m models.Metrics) {
-	// не блокируем продюсеров — канал с буфером; при переполнении лучше дропнуть/логировать
-	select {
-	case b.in <- m:
-	default:
-		logger.Log.Warn("batch channel full, metric dropped", zap.String("id", m.ID))
-	}
-}
-
-func (b *Batcher) Run() {
+// Run читает метрики из in до его закрытия, после чего отправляет остаток и дожидается
+// всех активных отправок. Отмена ctx прерывает отправки и останавливает Run сразу.
+func (b *Batcher) Run(ctx context.Context, in <-chan models.Metrics) {
 	t := time.NewTicker(b.flushInt)
 	defer t.Stop()
+	defer b.inflight.Wait()
 
 	buf := make([]models.Metrics, 0, b.maxSize)
 
@@ -60,33 +64,40 @@ func (b *Batcher) Run() {
 		if len(buf) == 0 {
 			return
 		}
-		payload, err := json.Marshal(buf)
-		if err != nil {
-			logger.Log.Error("marshal batch", zap.Error(err))
-			buf = buf[:0]
-			return
-		}
-		var gz bytes.Buffer
-		zw := gzip.NewWriter(&gz)
-		if _, err := zw.Write(payload); err != nil {
-			logger.Log.Error("gzip write", zap.Error(err))
-			buf = buf[:0]
-			_ = zw.Close()
+		batch := append([]models.Metrics(nil), buf...)
+		buf = buf[:0]
+
+		// пока на диске есть недосланные метрики, новые встают за ними в очередь
+		if b.outbox != nil && b.outbox.Active() {
+			b.toOutbox(batch)
 			return
 		}
-		_ = zw.Close()
 
-		// Отправляем пакет метрик на сервер
-		if err := b.postJSONWithRetry(context.Background(), b.endpoint, gz.Bytes()); err != nil {
-			logger.Log.Error("batch post error", zap.Error(err))
+		// ждём свободный слот: не больше rateLimit одновременных отправок
+		select {
+		case <-ctx.Done():
+			b.toOutbox(batch)
 			return
+		case b.sem <- struct{}{}:
 		}
-		buf = buf[:0]
+
+		b.inflight.Add(1)
+		go func() {
+			defer b.inflight.Done()
+			defer func() { <-b.sem }()
+
+			// Отправляем пакет метрик на сервер, при сбое связи — в очередь на диске
+			b.toOutbox(b.deliver(ctx, batch))
+		}()
 	}
 
 	for {
 		select {
-		case m, ok := <-b.in:
+		case <-ctx.Done():
+			// дедлайн остановки: неотправленный остаток сохраняем на диск
+			b.toOutbox(buf)
+			return
+		case m, ok := <-in:
 			if !ok {
 				flush()
 				return
@@ -101,40 +112,90 @@ func (b *Batcher) Run() {
 	}
 }
 
+// Send синхронно отправляет пакет выбранным транспортом
+func (b *Batcher) Send(ctx context.Context, batch []models.Metrics) error {
+	if b.transport != nil {
+		return b.transport.SendBatch(ctx, batch)
+	}
+	return b.sendHTTP(ctx, batch)
+}
+
+// deliver отправляет пакет и возвращает метрики, которые не дошли из-за сбоя связи или сервера.
+// Если сервер отверг пакет, метрики отправляются по одной: отвергнутые отбрасываются, остальные доходят.
+func (b *Batcher) deliver(ctx context.Context, batch []models.Metrics) []models.Metrics {
+	err := b.Send(ctx, batch)
+	switch {
+	case err == nil:
+		return nil
+	case !errors.Is(err, errRejected):
+		logger.Log.Error("batch post error", zap.Error(err))
+		return batch
+	case len(batch) == 1:
+		logger.Log.Warn("metric rejected by server, dropped", zap.String("id", batch[0].ID), zap.Error(err))
+		return nil
+	}
+
+	logger.Log.Warn("batch rejected by server, sending metrics one by one", zap.Int("metrics", len(batch)), zap.Error(err))
+	for i := range batch {
+		if unsent := b.deliver(ctx, batch[i:i+1]); unsent != nil {
+			return batch[i:]
+		}
+	}
+	return nil
+}
+
+// sendHTTP отправляет пакет на /updates: JSON подписывается до сжатия — так же, как и при поштучной отправке
+func (b *Batcher) sendHTTP(ctx context.Context, batch []models.Metrics) error {
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("marshal batch: %w", err)
+	}
+
+	var hash string
+	if b.key != "" {
+		hash = cryptohelpers.Sign(payload, b.key)
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write(payload); err != nil {
+		_ = zw.Close()
+		return fmt.Errorf("gzip write: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("gzip close: %w", err)
+	}
+
+	return b.postJSONWithRetry(ctx, b.endpoint, gz.Bytes(), hash)
+}
+
+func (b *Batcher) toOutbox(batch []models.Metrics) {
+	if b.outbox == nil || len(batch) == 0 {
+		return
+	}
+	if err := b.outbox.Put(batch...); err != nil {
+		logger.Log.Error("outbox put", zap.Error(err))
+	}
+}
+
 /////////////////////////////////
 
-func (b *Batcher) postJSONWithRetry(ctx context.Context, url string, body []byte) error {
+func (b *Batcher) postJSONWithRetry(ctx context.Context, url string, body []byte, hash string) error {
 	return retry.DoIf(ctx, httpDelays, func(ctx context.Context) error {
-		resp, err := b.client.R().
+		req := b.client.R().
 			SetContext(ctx).
 			SetHeader("Content-Type", "application/json").
 			SetHeader("Content-Encoding", "gzip").
-			SetBody(body).
-			Post(url)
+			SetHeader("Accept-Encoding", "gzip").
+			SetBody(body)
+		if hash != "" {
+			req.SetHeader("HashSHA256", hash)
+		}
+
+		resp, err := req.Post(url)
 		if err != nil {
 			return err
 		}
-		if resp.StatusCode() == http.StatusBadGateway ||
-			resp.StatusCode() == http.StatusServiceUnavailable ||
-			resp.StatusCode() == http.StatusGatewayTimeout {
-			return fmt.Errorf("temporary server error %d", resp.StatusCode())
-		}
-		if resp.StatusCode() >= 400 && resp.StatusCode() < 500 {
-			return fmt.Errorf("client error %d: %s", resp.StatusCode(), resp.String())
-		}
-		if resp.StatusCode() != http.StatusOK {
-			return fmt.Errorf("server error %d: %s", resp.StatusCode(), resp.String())
-		}
-		return nil
-	}, func(err error) bool {
-		if err == nil {
-			return false
-		}
-		var ne net.Error
-		if errors.As(err, &ne) && ne.Timeout() {
-			return true
-		}
-		// обрыв соединения и прочие транспортные ошибки — ретраим
-		return true
-	})
+		return httpStatusError(resp)
+	}, httpRetriable)
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+)
+
+// Collector — источник метрик агента. Collect возвращает gauge (текущее значение)
+// и counter (Delta — прирост с прошлого вызова); агент копит их до очередного отчёта.
+type Collector interface {
+	Name() string
+	Collect(ctx context.Context) ([]models.Metrics, error)
+}
+
+// CollectorFactory создаёт коллектор для агента
+type CollectorFactory func(a *Agent) Collector
+
+// collectorRegistration — коллектор в реестре с настройками по умолчанию
+type collectorRegistration struct {
+	name     string
+	interval time.Duration // 0 — интервал опроса агента (-p)
+	enabled  bool
+	factory  CollectorFactory
+}
+
+var collectorRegistry = map[string]collectorRegistration{}
+
+// RegisterCollector добавляет коллектор в реестр. Вызывается из init() файла коллектора,
+// поэтому для нового источника метрик достаточно добавить файл — main.go не меняется.
+func RegisterCollector(name string, interval time.Duration, enabled bool, factory CollectorFactory) {
+	if _, ok := collectorRegistry[name]; ok {
+		panic(fmt.Sprintf("collector %q already registered", name))
+	}
+	collectorRegistry[name] = collectorRegistration{name: name, interval: interval, enabled: enabled, factory: factory}
+}
+
+// collectorConfig — итоговые настройки коллектора после флагов
+type collectorConfig struct {
+	name     string
+	interval time.Duration
+	factory  CollectorFactory
+}
+
+// parseCollectors применяет к реестру настройки вида "runtime:2s,sys,-disk":
+// "name" — включить, "name:interval" — включить с интервалом, "-name" — выключить.
+func parseCollectors(spec string, pollInterval time.Duration) ([]collectorConfig, error) {
+	enabled := make(map[string]bool, len(collectorRegistry))
+	intervals := make(map[string]time.Duration, len(collectorRegistry))
+	for name, reg := range collectorRegistry {
+		enabled[name] = reg.enabled
+		intervals[name] = reg.interval
+	}
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if name, ok := strings.CutPrefix(part, "-"); ok {
+			if _, known := collectorRegistry[name]; !known {
+				return nil, fmt.Errorf("unknown collector %q", name)
+			}
+			enabled[name] = false
+			continue
+		}
+		name, intervalStr, hasInterval := strings.Cut(part, ":")
+		if _, known := collectorRegistry[name]; !known {
+			return nil, fmt.Errorf("unknown collector %q", name)
+		}
+		enabled[name] = true
+		if hasInterval {
+			d, err := time.ParseDuration(intervalStr)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("collector %q: invalid interval %q", name, intervalStr)
+			}
+			intervals[name] = d
+		}
+	}
+
+	configs := make([]collectorConfig, 0, len(enabled))
+	for name, on := range enabled {
+		if !on {
+			continue
+		}
+		interval := intervals[name]
+		if interval <= 0 {
+			interval = pollInterval
+		}
+		configs = append(configs, collectorConfig{name: name, interval: interval, factory: collectorRegistry[name].factory})
+	}
+	sort.Slice(configs, func(i, j int) bool { return configs[i].name < configs[j].name })
+	return configs, nil
+}
+
+// startCollectors запускает каждый коллектор со своим интервалом до отмены ctx
+func startCollectors(ctx context.Context, a *Agent, configs []collectorConfig, wg *sync.WaitGroup) {
+	for _, cfg := range configs {
+		c := cfg.factory(a)
+		wg.Add(1)
+		go func(every time.Duration) {
+			defer wg.Done()
+			t := time.NewTicker(every)
+			defer t.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+					if err := a.collect(ctx, c); err != nil {
+						log.Printf("[collector %s] %v", c.Name(), err)
+					}
+				}
+			}
+		}(cfg.interval)
+	}
+}
+
+// collect опрашивает коллектор и сохраняет результат в состоянии агента
+func (a *Agent) collect(ctx context.Context, c Collector) error {
+	ms, err := c.Collect(ctx)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, m := range ms {
+		switch m.MType {
+		case models.Gauge:
+			if m.Value != nil {
+				a.Metrics[m.SeriesID()] = *m.Value
+			}
+		case models.Counter:
+			if m.Delta != nil {
+				a.Counters[m.SeriesID()] += *m.Delta
+			}
+		}
+	}
+	// частичный результат сохраняем, ошибку отдаём для лога
+	return err
+}
+
+func gaugeMetric(id string, v float64) models.Metrics {
+	return models.Metrics{ID: id, MType: models.Gauge, Value: &v}
+}
+
+// deltaTracker переводит накопительные счётчики ОС в прирост для counter.
+// Первое значение серии только запоминается; уменьшение (сброс счётчика) считается приростом от нуля.
+type deltaTracker map[string]uint64
+
+func (t deltaTracker) counter(id string, labels models.Labels, cur uint64) (models.Metrics, bool) {
+	key := models.SeriesID(id, labels)
+	prev, seen := t[key]
+	t[key] = cur
+	if !seen {
+		return models.Metrics{}, false
+	}
+	delta := cur
+	if cur >= prev {
+		delta = cur - prev
+	}
+	d := int64(delta)
+	return models.Metrics{ID: id, MType: models.Counter, Delta: &d, Labels: labels}, true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+func init() {
+	RegisterCollector("disk", 10*time.Second, true, func(*Agent) Collector { return &diskCollector{io: deltaTracker{}} })
+}
+
+// diskCollector собирает заполненность файловых систем (метка mount) и ввод-вывод устройств (метка device)
+type diskCollector struct {
+	io deltaTracker
+}
+
+func (c *diskCollector) Name() string { return "disk" }
+
+func (c *diskCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	var ms []models.Metrics
+
+	parts, err := disk.PartitionsWithContext(ctx, false)
+	if err != nil {
+		return nil, fmt.Errorf("partitions: %w", err)
+	}
+	for _, p := range parts {
+		usage, err := disk.UsageWithContext(ctx, p.Mountpoint)
+		if err != nil {
+			continue // точка монтирования недоступна (нет прав, отмонтирована) — пропускаем
+		}
+		labels := models.Labels{"mount": p.Mountpoint}
+		for _, g := range []models.Metrics{
+			gaugeMetric("DiskTotalBytes", float64(usage.Total)),
+			gaugeMetric("DiskUsedBytes", float64(usage.Used)),
+			gaugeMetric("DiskFreeBytes", float64(usage.Free)),
+			gaugeMetric("DiskUsedPercent", usage.UsedPercent),
+		} {
+			g.Labels = labels
+			ms = append(ms, g)
+		}
+	}
+
+	counters, err := disk.IOCountersWithContext(ctx)
+	if err != nil {
+		return ms, fmt.Errorf("disk io: %w", err)
+	}
+	for name, io := range counters {
+		labels := models.Labels{"device": name}
+		for id, v := range map[string]uint64{
+			"DiskReadBytes":  io.ReadBytes,
+			"DiskWriteBytes": io.WriteBytes,
+			"DiskReadCount":  io.ReadCount,
+			"DiskWriteCount": io.WriteCount,
+		} {
+			if m, ok := c.io.counter(id, labels, v); ok {
+				ms = append(ms, m)
+			}
+		}
+	}
+	return ms, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/shirou/gopsutil/v3/host"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// Небольшие группы системных метрик: каждая — отдельный коллектор, чтобы включаться независимо
+func init() {
+	RegisterCollector("load", 5*time.Second, true, func(*Agent) Collector { return loadCollector{} })
+	RegisterCollector("swap", 10*time.Second, true, func(*Agent) Collector { return swapCollector{} })
+	RegisterCollector("uptime", 30*time.Second, true, func(*Agent) Collector { return uptimeCollector{} })
+	RegisterCollector("process", 10*time.Second, true, func(*Agent) Collector { return processCollector{pid: int32(os.Getpid())} })
+}
+
+// loadCollector — средняя загрузка системы за 1, 5 и 15 минут
+type loadCollector struct{}
+
+func (loadCollector) Name() string { return "load" }
+
+func (loadCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	avg, err := load.AvgWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("load: %w", err)
+	}
+	return []models.Metrics{
+		gaugeMetric("Load1", avg.Load1),
+		gaugeMetric("Load5", avg.Load5),
+		gaugeMetric("Load15", avg.Load15),
+	}, nil
+}
+
+// swapCollector — объём и заполненность swap
+type swapCollector struct{}
+
+func (swapCollector) Name() string { return "swap" }
+
+func (swapCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	sw, err := mem.SwapMemoryWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("swap: %w", err)
+	}
+	return []models.Metrics{
+		gaugeMetric("SwapTotal", float64(sw.Total)),
+		gaugeMetric("SwapUsed", float64(sw.Used)),
+		gaugeMetric("SwapFree", float64(sw.Free)),
+	}, nil
+}
+
+// uptimeCollector — время работы системы в секундах
+type uptimeCollector struct{}
+
+func (uptimeCollector) Name() string { return "uptime" }
+
+func (uptimeCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	up, err := host.UptimeWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("uptime: %w", err)
+	}
+	return []models.Metrics{gaugeMetric("Uptime", float64(up))}, nil
+}
+
+// processCollector — открытые файловые дескрипторы процесса агента
+type processCollector struct {
+	pid int32
+}
+
+func (processCollector) Name() string { return "process" }
+
+func (c processCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	p, err := process.NewProcessWithContext(ctx, c.pid)
+	if err != nil {
+		return nil, fmt.Errorf("process: %w", err)
+	}
+	fds, err := p.NumFDsWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("open fds: %w", err)
+	}
+	return []models.Metrics{gaugeMetric("OpenFDs", float64(fds))}, nil
+}
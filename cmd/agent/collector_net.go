@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/shirou/gopsutil/v3/net"
+)
+
+func init() {
+	RegisterCollector("net", 10*time.Second, true, func(*Agent) Collector { return &netCollector{io: deltaTracker{}} })
+}
+
+// netCollector собирает трафик, пакеты и ошибки по сетевым интерфейсам (метка iface)
+type netCollector struct {
+	io deltaTracker
+}
+
+func (c *netCollector) Name() string { return "net" }
+
+func (c *netCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	counters, err := net.IOCountersWithContext(ctx, true)
+	if err != nil {
+		return nil, fmt.Errorf("net io: %w", err)
+	}
+
+	var ms []models.Metrics
+	for _, io := range counters {
+		labels := models.Labels{"iface": io.Name}
+		for id, v := range map[string]uint64{
+			"NetBytesSent":   io.BytesSent,
+			"NetBytesRecv":   io.BytesRecv,
+			"NetPacketsSent": io.PacketsSent,
+			"NetPacketsRecv": io.PacketsRecv,
+			"NetErrorsIn":    io.Errin,
+			"NetErrorsOut":   io.Errout,
+		} {
+			if m, ok := c.io.counter(id, labels, v); ok {
+				ms = append(ms, m)
+			}
+		}
+	}
+	return ms, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -10,29 +11,33 @@ import (
 	"github.com/shirou/gopsutil/v3/mem"
 )
 
-func collectSysLoop(ctx context.Context, every time.Duration, out chan<- models.Metrics) {
-	t := time.NewTicker(every)
-	defer t.Stop()
+func init() {
+	RegisterCollector("sys", 5*time.Second, true, func(*Agent) Collector { return sysCollector{} })
+}
 
-	postGauge := func(id string, v float64) {
-		val := v
-		out <- models.Metrics{ID: id, MType: "gauge", Value: &val}
-	}
+// sysCollector собирает память и загрузку CPU по ядрам через gopsutil
+type sysCollector struct{}
+
+func (sysCollector) Name() string { return "sys" }
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-t.C:
-			if vm, err := mem.VirtualMemoryWithContext(ctx); err == nil {
-				postGauge("TotalMemory", float64(vm.Total))
-				postGauge("FreeMemory", float64(vm.Free))
-			}
-			if perc, err := cpu.PercentWithContext(ctx, 200*time.Millisecond, true); err == nil {
-				for i, p := range perc {
-					postGauge(fmt.Sprintf("CPUutilization%d", i+1), p)
-				}
-			}
+func (sysCollector) Collect(ctx context.Context) ([]models.Metrics, error) {
+	var ms []models.Metrics
+	var errs []error
+
+	if vm, err := mem.VirtualMemoryWithContext(ctx); err == nil {
+		ms = append(ms,
+			gaugeMetric("TotalMemory", float64(vm.Total)),
+			gaugeMetric("FreeMemory", float64(vm.Free)),
+		)
+	} else {
+		errs = append(errs, fmt.Errorf("memory: %w", err))
+	}
+	if perc, err := cpu.PercentWithContext(ctx, 200*time.Millisecond, true); err == nil {
+		for i, p := range perc {
+			ms = append(ms, gaugeMetric(fmt.Sprintf("CPUutilization%d", i+1), p))
 		}
+	} else {
+		errs = append(errs, fmt.Errorf("cpu: %w", err))
 	}
+	return ms, errors.Join(errs...)
 }
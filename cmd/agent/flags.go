@@ -3,26 +3,44 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 )
 
 // неэкспортированная переменная flagRunAddr содержит адрес и порт для запроса
 var (
-	flagRunAddr        string
-	flagReportInterval int64
-	flagPollInterval   int64
-	flagKey            string
-	flagRateLimit      int
+	flagRunAddr         string
+	flagReportInterval  int64
+	flagPollInterval    int64
+	flagKey             string
+	flagRateLimit       int
+	flagShutdownTimeout time.Duration
+	flagBatch           bool
+	flagBatchSize       int
+	flagOutboxPath      string
+	flagOutboxMax       int
+	flagCollectors      string
+	flagTransport       string
+	flagGRPCAddr        string
 )
 
 type Config struct {
-	RunAddr        string `env:"ADDRESS"`
-	ReportInterval int    `env:"REPORT_INTERVAL"`
-	PollInterval   int    `env:"POLL_INTERVAL"`
-	Key            string `env:"KEY"`
-	RateLimit      int    `env:"RATE_LIMIT"`
+	RunAddr         string        `env:"ADDRESS"`
+	ReportInterval  int           `env:"REPORT_INTERVAL"`
+	PollInterval    int           `env:"POLL_INTERVAL"`
+	Key             string        `env:"KEY"`
+	RateLimit       int           `env:"RATE_LIMIT"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT"`
+	Batch           bool          `env:"BATCH"`
+	BatchSize       int           `env:"BATCH_SIZE"`
+	OutboxPath      string        `env:"OUTBOX_PATH"`
+	OutboxMax       int           `env:"OUTBOX_MAX"`
+	Collectors      string        `env:"COLLECTORS"`
+	Transport       string        `env:"TRANSPORT"`
+	GRPCAddr        string        `env:"GRPC_ADDRESS"`
 }
 
 // parseFlags обрабатывает аргументы командной строки
@@ -42,6 +60,24 @@ func parseFlags() {
 
 	flag.IntVar(&flagRateLimit, "l", 0, "max concurrent outbound requests (RATE_LIMIT)")
 
+	flag.DurationVar(&flagShutdownTimeout, "shutdown-timeout", 10*time.Second, "max time to send pending metrics on shutdown")
+
+	// Флаг -b включает пакетную отправку метрик на /updates вместо поштучной на /update
+	flag.BoolVar(&flagBatch, "b", false, "send metrics in batches to /updates (BATCH)")
+	flag.IntVar(&flagBatchSize, "batch-size", 100, "max metrics per batch (BATCH_SIZE)")
+
+	// Флаг -o задаёт файл очереди неотправленных метрик; по умолчанию очередь выключена.
+	// У каждого экземпляра агента должен быть свой файл
+	flag.StringVar(&flagOutboxPath, "o", "", "outbox file for metrics not sent while the server is down (OUTBOX_PATH)")
+	flag.IntVar(&flagOutboxMax, "outbox-max", 10000, "max series kept in the outbox (OUTBOX_MAX)")
+
+	// Флаг -collectors включает, выключает и настраивает коллекторы: "runtime:1s,sys:10s,-disk"
+	flag.StringVar(&flagCollectors, "collectors", "", "collectors: name[:interval] to enable, -name to disable (COLLECTORS)")
+
+	// Флаг -transport выбирает протокол отправки: http (по умолчанию) или grpc на адрес -grpc-addr
+	flag.StringVar(&flagTransport, "transport", "http", "transport for sending metrics: http or grpc (TRANSPORT)")
+	flag.StringVar(&flagGRPCAddr, "grpc-addr", "localhost:3200", "gRPC server address for -transport=grpc (GRPC_ADDRESS)")
+
 	// парсим переданные аргументы в зарегистрированные переменные
 	flag.Parse()
 
@@ -93,4 +129,43 @@ func parseFlags() {
 		flagRateLimit = 1 // безопасный дефолт: без параллелизма
 	}
 
+	// Устанавливаем значение только если переменная окружения была явно задана
+	if _, ok := os.LookupEnv("BATCH"); ok {
+		flagBatch = cfg.Batch
+	}
+
+	if cfg.BatchSize > 0 {
+		flagBatchSize = cfg.BatchSize
+	}
+	if flagBatchSize <= 0 {
+		flagBatchSize = 100
+	}
+
+	if _, ok := os.LookupEnv("OUTBOX_PATH"); ok {
+		flagOutboxPath = cfg.OutboxPath
+	}
+
+	if cfg.OutboxMax > 0 {
+		flagOutboxMax = cfg.OutboxMax
+	}
+
+	if cfg.Collectors != "" {
+		flagCollectors = cfg.Collectors
+	}
+
+	if cfg.Transport != "" {
+		flagTransport = cfg.Transport
+	}
+	if flagTransport != "http" && flagTransport != "grpc" {
+		log.Fatalf("Неизвестный транспорт: %s", flagTransport)
+	}
+
+	if cfg.GRPCAddr != "" {
+		flagGRPCAddr = cfg.GRPCAddr
+	}
+
+	if cfg.ShutdownTimeout > 0 {
+		flagShutdownTimeout = cfg.ShutdownTimeout
+	}
+
 }
@@ -7,10 +7,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
-	"net"
+	"log"
 	"net/http"
-	"runtime"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/cryptohelpers"
@@ -23,26 +25,35 @@ import (
 
 var httpDelays = []time.Duration{time.Second, 3 * time.Second, 5 * time.Second}
 
+// batchFlushInterval — как часто Batcher отправляет неполный пакет
+const batchFlushInterval = time.Second
+
 // Agent инкапсулирует состояние и поведение агента для сбора и отправки метрик на сервер
 type Agent struct {
+	mu          sync.Mutex         // защищает состояние: коллекторы пишут параллельно с отчётом
 	PollCount   int64              // счётчик обновлений метрик
 	RandomValue float64            // случайное значение метрики
-	Metrics     map[string]float64 // метрики типа gauge из runtime
+	Metrics     map[string]float64 // метрики типа gauge от коллекторов, ключ — серия
+	Counters    map[string]int64   // прирост counter от коллекторов с прошлого отчёта
 	Client      *resty.Client      // HTTP-клиент
 	ServerURL   string             // адрес сервера
+	Outbox      *Outbox            // очередь неотправленных метрик на диске (nil — выключена)
+	Transport   Transport          // транспорт отправки (nil — HTTP через Client)
 }
 
 // NewAgent создаёт и возвращает новый экземпляр агента
 func NewAgent(serverURL string) *Agent {
 	return &Agent{
 		Metrics:   make(map[string]float64), // инициализируем хранилище метрик
+		Counters:  make(map[string]int64),   // прирост counter от коллекторов
 		Client:    resty.New(),              // Создаём HTTP-клиент resty
 		ServerURL: serverURL,                // Адрес сервера, куда будем отправлять метрики
 	}
 }
 
-// sendMetricJSON отправляет одну метрику на сервер в формате JSON, сжатом через gzip
-func (a *Agent) sendMetricJSON(metric models.Metrics) error {
+// sendMetricJSON отправляет одну метрику на сервер в формате JSON, сжатом через gzip.
+// Отмена ctx прерывает запрос и ретраи.
+func (a *Agent) sendMetricJSON(ctx context.Context, metric models.Metrics) error {
 
 	// Сериализуем метрику в JSON
 	var jsonBuf bytes.Buffer
@@ -64,9 +75,10 @@ func (a *Agent) sendMetricJSON(metric models.Metrics) error {
 	}
 
 	// Отправляем сжатый JSON
-	return retry.DoIf(context.Background(), httpDelays, func(ctx context.Context) error {
+	return retry.DoIf(ctx, httpDelays, func(ctx context.Context) error {
 
 		req := a.Client.R().
+			SetContext(ctx).
 			SetHeader("Content-Type", "application/json").
 			SetHeader("Content-Encoding", "gzip").
 			SetHeader("Accept-Encoding", "gzip"). // Говорим серверу: "Я поддерживаю сжатые ответы"
@@ -83,71 +95,106 @@ func (a *Agent) sendMetricJSON(metric models.Metrics) error {
 			logger.Log.Debug("send error", zap.Error(err))
 			return err
 		}
-		// 502/503/504 — ретраим
-		if resp.StatusCode() == http.StatusBadGateway ||
-			resp.StatusCode() == http.StatusServiceUnavailable ||
-			resp.StatusCode() == http.StatusGatewayTimeout {
-			return fmt.Errorf("temporary server error %d", resp.StatusCode())
-		}
-		// 4xx — НЕ ретраим, сразу фейл
-		if resp.StatusCode() >= 400 && resp.StatusCode() < 500 {
-			return fmt.Errorf("client error %d: %s", resp.StatusCode(), resp.String())
+		if err := httpStatusError(resp); err != nil {
+			return err
 		}
 		// успех
 		logger.Log.Debug("metric sent", zap.String("id", metric.ID), zap.String("type", metric.MType))
 		return nil
-	}, func(err error) bool {
-		// retryIf: ретраим только сетевые ошибки (err != nil)
-		if err == nil {
-			return false
-		}
-		var ne net.Error
-		if errors.As(err, &ne) && ne.Timeout() {
-			return true
+	}, httpRetriable)
+
+}
+
+// httpStatusError классифицирует ответ сервера: 4xx (кроме 408 и 429) — errRejected,
+// 5xx и прочие неуспешные коды — временная ошибка
+func httpStatusError(resp *resty.Response) error {
+	code := resp.StatusCode()
+	switch {
+	case code == http.StatusOK:
+		return nil
+	case code == http.StatusRequestTimeout || code == http.StatusTooManyRequests:
+		return fmt.Errorf("temporary server error %d", code)
+	case code >= 400 && code < 500:
+		return fmt.Errorf("%w: client error %d: %s", errRejected, code, resp.String())
+	default:
+		return fmt.Errorf("server error %d: %s", code, resp.String())
+	}
+}
+
+// httpRetriable — ретраим сетевые сбои и временные ошибки сервера, отвергнутые запросы — нет
+func httpRetriable(err error) bool {
+	return err != nil && !errors.Is(err, errRejected)
+}
+
+// send отправляет одну метрику выбранным транспортом
+func (a *Agent) send(ctx context.Context, m models.Metrics) error {
+	if a.Transport != nil {
+		return a.Transport.Send(ctx, m)
+	}
+	return a.sendMetricJSON(ctx, m)
+}
+
+// deliver досылает метрики по одной и возвращает неотправленные, начиная с первого сбоя связи.
+// Отвергнутые сервером метрики отбрасываются — иначе одна такая метрика навсегда остановила бы очередь.
+func (a *Agent) deliver(ctx context.Context, ms []models.Metrics) []models.Metrics {
+	for i, m := range ms {
+		err := a.send(ctx, m)
+		switch {
+		case err == nil:
+		case errors.Is(err, errRejected):
+			log.Printf("%s rejected by server, dropped: %v", m.ID, err)
+		default:
+			return ms[i:]
 		}
-		// обрыв соединения/временная недоступность — тоже ретраим
-		return true
-	})
+	}
+	return nil
+}
 
+// toOutbox откладывает метрику, которую не удалось отправить, в очередь на диске
+func (a *Agent) toOutbox(m models.Metrics) {
+	if a.Outbox == nil {
+		return
+	}
+	if err := a.Outbox.Put(m); err != nil {
+		log.Printf("outbox put error for %s: %v", m.ID, err)
+	}
 }
 
 // collectMetrics собирает метрики из runtime и обновляет состояние агента
 func (a *Agent) collectMetrics() {
+	_ = a.collect(context.Background(), &runtimeCollector{agent: a})
+}
 
-	var m runtime.MemStats   // Считываем текущие значения метрик
-	runtime.ReadMemStats(&m) // Обновляем метрики в агенте
-
-	// обновляем runtime метрики
-	a.Metrics["Alloc"] = float64(m.Alloc)
-	a.Metrics["BuckHashSys"] = float64(m.BuckHashSys)
-	a.Metrics["Frees"] = float64(m.Frees)
-	a.Metrics["GCCPUFraction"] = m.GCCPUFraction
-	a.Metrics["GCSys"] = float64(m.GCSys)
-	a.Metrics["HeapAlloc"] = float64(m.HeapAlloc)
-	a.Metrics["HeapIdle"] = float64(m.HeapIdle)
-	a.Metrics["HeapInuse"] = float64(m.HeapInuse)
-	a.Metrics["HeapObjects"] = float64(m.HeapObjects)
-	a.Metrics["HeapReleased"] = float64(m.HeapReleased)
-	a.Metrics["HeapSys"] = float64(m.HeapSys)
-	a.Metrics["LastGC"] = float64(m.LastGC)
-	a.Metrics["Lookups"] = float64(m.Lookups)
-	a.Metrics["MCacheInuse"] = float64(m.MCacheInuse)
-	a.Metrics["MCacheSys"] = float64(m.MCacheSys)
-	a.Metrics["MSpanInuse"] = float64(m.MSpanInuse)
-	a.Metrics["MSpanSys"] = float64(m.MSpanSys)
-	a.Metrics["Mallocs"] = float64(m.Mallocs)
-	a.Metrics["NextGC"] = float64(m.NextGC)
-	a.Metrics["NumForcedGC"] = float64(m.NumForcedGC)
-	a.Metrics["NumGC"] = float64(m.NumGC)
-	a.Metrics["OtherSys"] = float64(m.OtherSys)
-	a.Metrics["PauseTotalNs"] = float64(m.PauseTotalNs)
-	a.Metrics["StackInuse"] = float64(m.StackInuse)
-	a.Metrics["StackSys"] = float64(m.StackSys)
-	a.Metrics["Sys"] = float64(m.Sys)
-	a.Metrics["TotalAlloc"] = float64(m.TotalAlloc)
-
-	a.RandomValue = rand.Float64() // Обновляем случайное значение метрики
-	a.PollCount++                  // Увеличиваем счётчик обновлений
+// enqueueReport ставит в очередь на отправку текущее состояние агента.
+// Возвращает false, если ctx отменён раньше, чем все метрики попали в очередь.
+func (a *Agent) enqueueReport(ctx context.Context, jobs chan<- models.Metrics) bool {
+	a.mu.Lock()
+	batch := make([]models.Metrics, 0, len(a.Metrics)+len(a.Counters)+2)
+	// gauge из карты
+	for key, val := range a.Metrics {
+		batch = append(batch, models.SeriesMetric(key, models.Gauge, val, 0))
+	}
+	// counter коллекторов: отправляем накопленный прирост и начинаем копить заново
+	for key, delta := range a.Counters {
+		batch = append(batch, models.SeriesMetric(key, models.Counter, 0, delta))
+	}
+	clear(a.Counters)
+	// RandomValue как gauge
+	rv := a.RandomValue
+	batch = append(batch, models.Metrics{ID: "RandomValue", MType: "gauge", Value: &rv})
+	// PollCount как counter
+	pc := a.PollCount
+	batch = append(batch, models.Metrics{ID: "PollCount", MType: "counter", Delta: &pc})
+	a.mu.Unlock()
+
+	for _, m := range batch {
+		select {
+		case <-ctx.Done():
+			return false
+		case jobs <- m:
+		}
+	}
+	return true
 }
 
 func main() {
@@ -158,30 +205,60 @@ func main() {
 	reportInterval := time.Duration(flagReportInterval) * time.Second // Интервал отправки метрик на сервер, по умолчанию 10 секунд
 	pollInterval := time.Duration(flagPollInterval) * time.Second     // Интервал обновления метрик, по умолчанию 2 секунды
 
+	// коллекторы из реестра с учётом -collectors
+	collectors, err := parseCollectors(flagCollectors, pollInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	agent := NewAgent(flagRunAddr) // Создаём нового агента с адресом сервера
 
+	// Очередь на диске: метрики, не отправленные из-за недоступности сервера, досылаются позже
+	if flagOutboxPath != "" {
+		outbox, err := NewOutbox(flagOutboxPath, flagOutboxMax)
+		if err != nil {
+			log.Printf("outbox disabled: %v", err)
+		} else {
+			agent.Outbox = outbox
+			// Put пишет файл не чаще outboxSaveInterval — перед выходом сохраняем последние изменения
+			defer func() {
+				if err := outbox.Flush(); err != nil {
+					log.Printf("outbox save error: %v", err)
+				}
+			}()
+		}
+	}
+
+	// gRPC вместо HTTP: и поштучная, и пакетная отправка идут через сервис Metrics
+	if flagTransport == "grpc" {
+		t, err := newGRPCTransport(flagGRPCAddr, flagKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer t.Close()
+		agent.Transport = t
+	}
+
 	// Канал заданий на отправку
 	jobs := make(chan models.Metrics, 2048)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// ctx отменяется по SIGINT/SIGTERM и останавливает сбор метрик
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// (а) Сбор runtime по pollInterval — только обновляет состояние агентa
-	go func() {
-		t := time.NewTicker(pollInterval)
-		defer t.Stop()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-t.C:
-				agent.collectMetrics()
-			}
-		}
-	}()
+	// sendCtx живёт дольше ctx: отправка продолжается после сигнала и прерывается только по дедлайну остановки
+	sendCtx, cancelSend := context.WithCancel(context.Background())
+	defer cancelSend()
+
+	var producers sync.WaitGroup
+
+	// (а) Коллекторы из реестра, каждый со своим интервалом, — только обновляют состояние агента
+	startCollectors(ctx, agent, collectors, &producers)
 
 	// (б) Формирование заданий для отправки по reportInterval
+	producers.Add(1)
 	go func() {
+		defer producers.Done()
 		t := time.NewTicker(reportInterval)
 		defer t.Stop()
 		for {
@@ -189,28 +266,66 @@ func main() {
 			case <-ctx.Done():
 				return
 			case <-t.C:
-				// gauge из карты
-				for name, val := range agent.Metrics {
-					v := val
-					jobs <- models.Metrics{ID: name, MType: "gauge", Value: &v}
-				}
-				// RandomValue как gauge
-				rv := agent.RandomValue
-				jobs <- models.Metrics{ID: "RandomValue", MType: "gauge", Value: &rv}
-				// PollCount как counter
-				pc := agent.PollCount
-				jobs <- models.Metrics{ID: "PollCount", MType: "counter", Delta: &pc}
+				agent.enqueueReport(ctx, jobs)
 			}
 		}
 	}()
 
-	// (в) Системные метрики через gopsutil (каждые 5s)
-	go collectSysLoop(ctx, 5*time.Second, jobs)
+	// Отправка: поштучно на /update через пул воркеров или пакетами на /updates через Batcher.
+	// В обоих режимах -l ограничивает число одновременных исходящих запросов.
+	var senders *sync.WaitGroup
+	var replay replayFunc
+	if flagBatch {
+		batcher := NewBatcher(flagRunAddr+"/updates", batchFlushInterval, flagBatchSize, flagKey, flagRateLimit)
+		batcher.outbox = agent.Outbox
+		batcher.transport = agent.Transport
+		senders = &sync.WaitGroup{}
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			batcher.Run(sendCtx, jobs)
+		}()
+		// очередь досылается одним пакетом
+		replay = batcher.deliver
+	} else {
+		senders = startWorkers(sendCtx, flagRateLimit, jobs, agent)
+		// очередь досылается по одной метрике, с первого сбоя связи остаток остаётся в очереди
+		replay = agent.deliver
+	}
 
-	// Пул воркеров ограничивает число одновременных исходящих запросов
-	_ = startWorkers(ctx, flagRateLimit, jobs, agent)
+	// досылка очереди останавливается вместе со сбором: недосланное остаётся на диске до следующего запуска
+	if agent.Outbox != nil {
+		go runOutbox(ctx, agent.Outbox, replay, outboxReplayInterval)
+	}
 
-	// Блокируемся (упрощённо). Для graceful shutdown можно ловить SIGINT/SIGTERM.
-	select {}
+	<-ctx.Done()
+	log.Printf("shutting down, waiting up to %s for pending metrics", flagShutdownTimeout)
 
+	// по истечении дедлайна прерываем отправку, даже если очередь не разобрана
+	deadline := time.AfterFunc(flagShutdownTimeout, cancelSend)
+	defer deadline.Stop()
+
+	// новых заданий больше не будет: дожидаемся продюсеров, ставим финальный отчёт и закрываем очередь
+	producers.Wait()
+	if !agent.enqueueReport(sendCtx, jobs) {
+		log.Printf("final report dropped: shutdown deadline exceeded")
+	}
+	close(jobs)
+
+	senders.Wait()
+	if sendCtx.Err() != nil {
+		// то, что не успели отправить, сохраняем в очередь на диске
+		var left []models.Metrics
+		for m := range jobs {
+			left = append(left, m)
+		}
+		if agent.Outbox != nil && len(left) > 0 {
+			if err := agent.Outbox.Put(left...); err != nil {
+				log.Printf("outbox put error: %v", err)
+			}
+		}
+		log.Printf("shutdown deadline exceeded, %d queued metrics not sent", len(left))
+		return
+	}
+	log.Printf("agent stopped, all pending metrics sent")
 }
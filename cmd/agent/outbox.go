@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"go.uber.org/zap"
+)
+
+// outboxReplayInterval — как часто агент пытается дослать накопленные метрики
+const outboxReplayInterval = 5 * time.Second
+
+// outboxSaveInterval — как часто Put переписывает файл очереди: во время простоя сервера
+// метрики приходят с частотой опроса, и сохранять файл на каждую было бы слишком дорого
+const outboxSaveInterval = time.Second
+
+// outboxEntry — метрика в очереди; seq задаёт порядок отправки
+type outboxEntry struct {
+	seq    int64
+	metric models.Metrics
+}
+
+// Outbox — очередь неотправленных метрик на диске на время недоступности сервера.
+// Пока метрика ждёт отправки, gauge схлопывается до последнего значения, а delta у counter суммируется,
+// поэтому размер очереди ограничен числом серий (maxEntries).
+type Outbox struct {
+	mu         sync.Mutex
+	path       string
+	maxEntries int
+	nextSeq    int64
+	pending    map[string]*outboxEntry // ключ — тип + серия
+	inflight   []models.Metrics        // выданы Drain и ещё не подтверждены Done
+	dirty      bool                    // есть изменения, не записанные в файл
+	savedAt    time.Time
+}
+
+// NewOutbox открывает очередь в файле path; метрики, оставшиеся с прошлого запуска, загружаются.
+func NewOutbox(path string, maxEntries int) (*Outbox, error) {
+	o := &Outbox{
+		path:       path,
+		maxEntries: maxEntries,
+		pending:    make(map[string]*outboxEntry),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return o, nil // если файла нет — это не ошибка
+		}
+		return nil, err
+	}
+	var saved []models.Metrics
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("outbox %s: %w", path, err)
+	}
+	o.put(saved)
+	return o, nil
+}
+
+func outboxKey(m models.Metrics) string {
+	return m.MType + ":" + m.SeriesID()
+}
+
+// Put добавляет метрики в конец очереди. Файл переписывается не чаще outboxSaveInterval,
+// остальные изменения сохраняет Flush (его вызывают досылка и остановка агента).
+func (o *Outbox) Put(ms ...models.Metrics) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.put(ms)
+	o.dirty = true
+	if time.Since(o.savedAt) < outboxSaveInterval {
+		return nil
+	}
+	return o.save()
+}
+
+// Flush записывает на диск изменения, отложенные Put
+func (o *Outbox) Flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.dirty {
+		return nil
+	}
+	return o.save()
+}
+
+// Active сообщает, есть ли метрики в очереди или в процессе досылки.
+// Пока очередь активна, новые метрики тоже идут через неё, чтобы не обогнать более старые.
+func (o *Outbox) Active() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending) > 0 || o.inflight != nil
+}
+
+// Drain забирает все ожидающие метрики в порядке поступления.
+// До вызова Done они остаются в файле, чтобы не потеряться при аварийном завершении.
+func (o *Outbox) Drain() []models.Metrics {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.inflight != nil || len(o.pending) == 0 {
+		return nil
+	}
+	entries := o.sorted()
+	out := make([]models.Metrics, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, e.metric)
+	}
+	o.pending = make(map[string]*outboxEntry)
+	o.inflight = out
+	return out
+}
+
+// Done завершает досылку: unsent возвращаются в начало очереди.
+// Пришедший за это время gauge новее неотправленного и остаётся, delta у counter суммируются.
+func (o *Outbox) Done(unsent []models.Metrics) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.inflight = nil
+
+	seq := o.minSeq() - int64(len(unsent))
+	for _, m := range unsent {
+		key := outboxKey(m)
+		if e, ok := o.pending[key]; ok {
+			if m.MType == models.Counter && m.Delta != nil && e.metric.Delta != nil {
+				sum := *m.Delta + *e.metric.Delta
+				e.metric.Delta = &sum
+			}
+			e.seq = seq
+		} else {
+			o.pending[key] = &outboxEntry{seq: seq, metric: m}
+		}
+		seq++
+	}
+	o.evict()
+	return o.save()
+}
+
+// put объединяет метрики с очередью; вызывается под o.mu
+func (o *Outbox) put(ms []models.Metrics) {
+	for _, m := range ms {
+		key := outboxKey(m)
+		if e, ok := o.pending[key]; ok {
+			switch m.MType {
+			case models.Counter:
+				if m.Delta != nil && e.metric.Delta != nil {
+					sum := *e.metric.Delta + *m.Delta
+					e.metric.Delta = &sum
+				}
+			default:
+				e.metric = m // gauge: остаётся последнее значение
+			}
+			continue
+		}
+		o.pending[key] = &outboxEntry{seq: o.nextSeq, metric: m}
+		o.nextSeq++
+	}
+	o.evict()
+}
+
+// evict соблюдает лимит очереди: сначала вытесняются самые старые gauge, затем counter
+func (o *Outbox) evict() {
+	if o.maxEntries <= 0 || len(o.pending) <= o.maxEntries {
+		return
+	}
+	entries := o.sorted()
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].metric.MType == models.Gauge && entries[j].metric.MType != models.Gauge
+	})
+	for _, e := range entries[:len(o.pending)-o.maxEntries] {
+		logger.Log.Warn("outbox is full, metric dropped", zap.String("id", e.metric.ID), zap.String("type", e.metric.MType))
+		delete(o.pending, outboxKey(e.metric))
+	}
+}
+
+func (o *Outbox) sorted() []*outboxEntry {
+	entries := make([]*outboxEntry, 0, len(o.pending))
+	for _, e := range o.pending {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	return entries
+}
+
+func (o *Outbox) minSeq() int64 {
+	lowest := o.nextSeq
+	for _, e := range o.pending {
+		if e.seq < lowest {
+			lowest = e.seq
+		}
+	}
+	return lowest
+}
+
+// save атомарно перезаписывает файл очереди: сначала досылаемые метрики, затем ожидающие
+func (o *Outbox) save() error {
+	all := make([]models.Metrics, 0, len(o.inflight)+len(o.pending))
+	all = append(all, o.inflight...)
+	for _, e := range o.sorted() {
+		all = append(all, e.metric)
+	}
+
+	if len(all) == 0 {
+		if err := os.Remove(o.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		o.dirty, o.savedAt = false, time.Now()
+		return nil
+	}
+
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(o.path), filepath.Base(o.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), o.path); err != nil {
+		return err
+	}
+	o.dirty, o.savedAt = false, time.Now()
+	return nil
+}
+
+// replayFunc отправляет метрики по порядку и возвращает те, что отправить не удалось
+type replayFunc func(ctx context.Context, ms []models.Metrics) []models.Metrics
+
+// runOutbox периодически досылает накопленные метрики, пока не отменён ctx
+func runOutbox(ctx context.Context, o *Outbox, send replayFunc, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := o.Flush(); err != nil {
+				logger.Log.Error("outbox save", zap.Error(err))
+			}
+			ms := o.Drain()
+			if ms == nil {
+				continue
+			}
+			unsent := send(ctx, ms)
+			if err := o.Done(unsent); err != nil {
+				logger.Log.Error("outbox save", zap.Error(err))
+			}
+			if len(unsent) == 0 {
+				logger.Log.Info("outbox replayed", zap.Int("metrics", len(ms)))
+			}
+		}
+	}
+}
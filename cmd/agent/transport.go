@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/grpcapi"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/metricspb"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/retry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Transport отправляет метрики на сервер: поштучно (пул воркеров) и пакетом (Batcher, досылка очереди).
+// nil-транспорт у агента означает HTTP через resty.
+type Transport interface {
+	Send(ctx context.Context, m models.Metrics) error
+	SendBatch(ctx context.Context, batch []models.Metrics) error
+}
+
+// errRejected — сервер окончательно отверг метрику (ошибка валидации, подписи и т.п.):
+// повторная отправка не поможет, поэтому такие метрики не ретраятся и не откладываются в очередь
+var errRejected = errors.New("rejected by server")
+
+// grpcBatchChunk — сколько метрик уходит в одном сообщении потока UpdateBatch
+const grpcBatchChunk = 500
+
+// grpcTransport отправляет метрики в gRPC-сервис Metrics; подпись HMAC передаётся в metadata
+type grpcTransport struct {
+	conn   *grpc.ClientConn
+	client metricspb.MetricsClient
+	key    string
+}
+
+func newGRPCTransport(addr, key string) (*grpcTransport, error) {
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(grpcapi.UnaryClientHMAC(key)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("grpc client: %w", err)
+	}
+	return &grpcTransport{conn: conn, client: metricspb.NewMetricsClient(conn), key: key}, nil
+}
+
+func (t *grpcTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *grpcTransport) Send(ctx context.Context, m models.Metrics) error {
+	return grpcRejected(retry.DoIf(ctx, httpDelays, func(ctx context.Context) error {
+		_, err := t.client.Update(ctx, &metricspb.UpdateRequest{Metric: grpcapi.ToProto(m)})
+		return err
+	}, grpcRetriable))
+}
+
+// SendBatch отправляет пакет одним потоком UpdateBatch; сервер применяет его целиком
+func (t *grpcTransport) SendBatch(ctx context.Context, batch []models.Metrics) error {
+	var parts []*metricspb.UpdateBatchRequest
+	for start := 0; start < len(batch); start += grpcBatchChunk {
+		end := min(start+grpcBatchChunk, len(batch))
+		part := &metricspb.UpdateBatchRequest{Metrics: make([]*metricspb.Metric, 0, end-start)}
+		for _, m := range batch[start:end] {
+			part.Metrics = append(part.Metrics, grpcapi.ToProto(m))
+		}
+		parts = append(parts, part)
+	}
+	msgs := make([]proto.Message, len(parts))
+	for i, p := range parts {
+		msgs[i] = p
+	}
+
+	return grpcRejected(retry.DoIf(ctx, httpDelays, func(ctx context.Context) error {
+		// подпись покрывает все сообщения потока и уходит в metadata при его открытии
+		signed, err := grpcapi.SignContext(ctx, t.key, msgs...)
+		if err != nil {
+			return err
+		}
+		stream, err := t.client.UpdateBatch(signed)
+		if err != nil {
+			return err
+		}
+		for _, p := range parts {
+			if err := stream.Send(p); err != nil {
+				if errors.Is(err, io.EOF) {
+					break // сервер закрыл поток — настоящую ошибку вернёт CloseAndRecv
+				}
+				return err
+			}
+		}
+		_, err = stream.CloseAndRecv()
+		return err
+	}, grpcRetriable))
+}
+
+// grpcRetriable — ретраим временную недоступность сервера, ошибки запроса — нет
+func grpcRetriable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// grpcRejected помечает errRejected ответы, которые сервер не примет и при повторе.
+// ResourceExhausted — слишком большой пакет: Batcher досылает его метрики по одной
+func grpcRejected(err error) error {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.Unauthenticated, codes.PermissionDenied,
+		codes.FailedPrecondition, codes.OutOfRange, codes.ResourceExhausted:
+		return fmt.Errorf("%w: %w", errRejected, err)
+	}
+	return err
+}
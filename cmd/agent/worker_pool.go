@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"sync"
 
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
 )
 
+// startWorkers запускает n воркеров, отправляющих метрики из jobs.
+// Воркеры разбирают очередь до её закрытия; отмена ctx прерывает отправку и останавливает их.
 func startWorkers(ctx context.Context, n int, jobs <-chan models.Metrics, agent *Agent) *sync.WaitGroup {
 	if n < 1 {
 		n = 1
@@ -26,8 +29,19 @@ func startWorkers(ctx context.Context, n int, jobs <-chan models.Metrics, agent
 					if !ok {
 						return
 					}
-					if err := agent.sendMetricJSON(m); err != nil {
+					// пока на диске есть недосланные метрики, новые встают за ними в очередь
+					if agent.Outbox != nil && agent.Outbox.Active() {
+						agent.toOutbox(m)
+						continue
+					}
+					if err := agent.send(ctx, m); err != nil {
+						if errors.Is(err, errRejected) {
+							// повтор не поможет — не держим метрику в очереди
+							log.Printf("[worker %d] %s rejected by server, dropped: %v", id, m.ID, err)
+							continue
+						}
 						log.Printf("[worker %d] send error for %s: %v", id, m.ID, err)
+						agent.toOutbox(m)
 					}
 				}
 			}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/alert"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/handler"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/middleware"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/stream"
+	"github.com/go-chi/chi/v5"
+)
+
+// apiDeps — зависимости обработчиков /api/v1
+type apiDeps struct {
+	reader  repository.Storage // чтение
+	writer  repository.Storage // запись с публикацией обновлений в поток
+	key     string
+	hub     *stream.Hub
+	history repository.HistoryReader // nil — режим -history выключен
+	alerts  *alert.Engine            // nil — алерты выключены
+	persist func() error             // сохранение снапшота после удаления и сброса; nil — не нужно
+}
+
+// apiV1Router — версионированный JSON API. Старые маршруты (/update, /updates, /value) работают
+// с теми же обработчиками; ошибки везде в формате handler.ErrorResponse, включая неизвестные маршруты.
+func apiV1Router(d apiDeps) http.Handler {
+	r := chi.NewRouter()
+	r.NotFound(handler.NotFound)
+	r.MethodNotAllowed(handler.MethodNotAllowed)
+
+	hashMiddleware := middleware.ValidateHashSHA256(d.key)
+	r.With(hashMiddleware).Post("/update", updateHandlerJSON(d.writer))
+	r.With(hashMiddleware).Post("/updates", handler.UpdatesHandler(d.writer, d.key))
+	r.Post("/value", valueHandlerJSON(d.reader))
+
+	// поток обновлений (SSE)
+	r.Get("/stream", handler.StreamHandler(d.hub))
+
+	if d.history != nil {
+		r.Get("/query_range", handler.QueryRangeHandler(d.history, d.key))
+	}
+	if d.alerts != nil {
+		r.Get("/alerts", handler.AlertsHandler(d.alerts, d.key))
+	}
+	// удаление серий и сброс counter — только с подписью HashSHA256
+	if deleter, ok := d.reader.(repository.Deleter); ok {
+		admin := r.With(middleware.RequireHashSHA256(d.key))
+		admin.Post("/admin/delete", handler.DeleteHandler(deleter, d.persist, d.key))
+		admin.Post("/admin/reset", handler.ResetHandler(deleter, d.persist, d.key))
+	}
+	return r
+}
+
+// snapshotFunc — сохранение файлового снапшота после удаления и сброса, чтобы удалённые серии
+// не вернулись при рестарте с -r до очередного PeriodicStore. nil — хранилище не in-memory или файл не задан.
+func snapshotFunc(storage repository.Storage, filename string) func() error {
+	memStorage, ok := storage.(*repository.MemStorage)
+	if !ok || filename == "" {
+		return nil
+	}
+	return func() error { return memStorage.SaveToFile(filename) }
+}
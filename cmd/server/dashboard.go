@@ -0,0 +1,276 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/handler"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"go.uber.org/zap"
+)
+
+// шаблон и статика дашборда зашиты в бинарник
+//
+//go:embed dashboard
+var dashboardFS embed.FS
+
+var dashboardTmpl = template.Must(template.ParseFS(dashboardFS, "dashboard/index.html"))
+
+const (
+	defaultDashboardRefresh = 10 // секунды; ?refresh=0 отключает автообновление
+	sparkWindow             = 15 * time.Minute
+	sparkPoints             = 60
+	sparkWidth              = 120
+	sparkHeight             = 24
+	sparkTTL                = time.Minute // спарклайн пересчитывается не чаще, чем раз в sparkTTL
+	maxSparklines           = 100         // в каждой таблице; у остальных строк спарклайна нет
+)
+
+// dashboardRow — строка таблицы: Value — для глаз, Raw — точное значение для сортировки и подсказки
+type dashboardRow struct {
+	Series string
+	ID     string
+	Labels string
+	Value  string
+	Raw    string
+	Spark  string // точки polyline; пусто — истории нет
+}
+
+// dashboardTable — таблица метрик одного типа
+type dashboardTable struct {
+	Title string
+	Type  string
+	Rows  []dashboardRow
+}
+
+type dashboardPage struct {
+	Tables     []dashboardTable
+	Filter     string
+	Refresh    int
+	Sparklines bool
+	Updated    string
+}
+
+// dashboardAssets отдаёт CSS и JS дашборда под /assets/
+func dashboardAssets() http.Handler {
+	sub, err := fs.Sub(dashboardFS, "dashboard/assets")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/assets/", http.FileServerFS(sub))
+}
+
+// dashboardHandler — GET /: таблицы gauge и counter, отсортированные по ключу серии, с поиском и автообновлением.
+// history может быть nil — тогда спарклайны не рисуются.
+func dashboardHandler(storage repository.Storage, history repository.HistoryReader) http.HandlerFunc {
+	sparks := newSparkCache(history)
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		filter, err := models.ParseLabelFilter(q["label"])
+		if err != nil {
+			handler.WriteError(w, http.StatusBadRequest, handler.CodeInvalidLabels, "invalid label filter")
+			return
+		}
+		refresh := defaultDashboardRefresh
+		if s := q.Get("refresh"); s != "" {
+			if refresh, err = strconv.Atoi(s); err != nil || refresh < 0 {
+				handler.WriteError(w, http.StatusBadRequest, handler.CodeInvalidParam, "invalid refresh")
+				return
+			}
+		}
+
+		gauges, counters, err := storage.GetAllMetrics(r.Context())
+		if err != nil {
+			handler.WriteStorageError(w, err)
+			return
+		}
+		filterSeries(gauges, filter)
+		filterSeries(counters, filter)
+
+		now := time.Now()
+		page := dashboardPage{
+			Filter:     labelList(filter),
+			Refresh:    refresh,
+			Sparklines: history != nil,
+			Updated:    now.Format(time.TimeOnly),
+		}
+
+		gaugeRows := make([]dashboardRow, 0, len(gauges))
+		for key, v := range gauges {
+			gaugeRows = append(gaugeRows, newDashboardRow(key, formatGauge(v), strconv.FormatFloat(v, 'f', -1, 64)))
+		}
+		counterRows := make([]dashboardRow, 0, len(counters))
+		for key, v := range counters {
+			counterRows = append(counterRows, newDashboardRow(key, formatCounter(v), strconv.FormatInt(v, 10)))
+		}
+		page.Tables = []dashboardTable{
+			{Title: "Gauges", Type: models.Gauge, Rows: gaugeRows},
+			{Title: "Counters", Type: models.Counter, Rows: counterRows},
+		}
+		for _, t := range page.Tables {
+			sort.Slice(t.Rows, func(i, j int) bool { return t.Rows[i].Series < t.Rows[j].Series })
+			if history != nil {
+				sparks.fill(r, t.Type, t.Rows, now)
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTmpl.Execute(w, page); err != nil {
+			logger.Log.Error("render dashboard", zap.Error(err))
+		}
+	}
+}
+
+func newDashboardRow(key, value, raw string) dashboardRow {
+	id, labels := models.ParseSeriesID(key)
+	return dashboardRow{Series: key, ID: id, Labels: labelList(labels), Value: value, Raw: raw}
+}
+
+// labelList — метки без фигурных скобок: host="a",region="eu"
+func labelList(l models.Labels) string {
+	return strings.TrimSuffix(strings.TrimPrefix(l.String(), "{"), "}")
+}
+
+// sparkCache хранит построенные спарклайны: автообновление дашборда не должно
+// запрашивать историю каждой серии раз в несколько секунд
+type sparkCache struct {
+	history repository.HistoryReader
+	mu      sync.Mutex
+	entries map[string]sparkEntry // по типу и ключу серии
+}
+
+type sparkEntry struct {
+	points string
+	at     time.Time
+}
+
+func newSparkCache(history repository.HistoryReader) *sparkCache {
+	return &sparkCache{history: history, entries: make(map[string]sparkEntry)}
+}
+
+// fill строит спарклайны по истории за sparkWindow для первых maxSparklines строк.
+// История запрашивается только для серий, чей спарклайн старше sparkTTL; ошибки чтения страницу не ломают.
+func (c *sparkCache) fill(r *http.Request, mtype string, rows []dashboardRow, now time.Time) {
+	rows = rows[:min(len(rows), maxSparklines)]
+	from := now.Add(-sparkWindow)
+
+	c.mu.Lock()
+	for key, e := range c.entries {
+		if now.Sub(e.at) >= sparkTTL {
+			delete(c.entries, key)
+		}
+	}
+	var stale []int
+	for i := range rows {
+		if e, ok := c.entries[mtype+":"+rows[i].Series]; ok {
+			rows[i].Spark = e.points
+		} else {
+			stale = append(stale, i)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, i := range stale {
+		samples, err := c.history.QueryRange(r.Context(), mtype, rows[i].Series, from, now, sparkWindow/sparkPoints)
+		if err != nil {
+			continue
+		}
+		rows[i].Spark = sparkline(samples, sparkWidth, sparkHeight)
+		c.mu.Lock()
+		c.entries[mtype+":"+rows[i].Series] = sparkEntry{points: rows[i].Spark, at: now}
+		c.mu.Unlock()
+	}
+}
+
+// sparkline переводит сэмплы в точки polyline "x,y x,y ..." в прямоугольнике w×h (y растёт вниз)
+func sparkline(samples []repository.Sample, w, h float64) string {
+	if len(samples) < 2 {
+		return ""
+	}
+	lo, hi := samples[0].Value, samples[0].Value
+	for _, s := range samples[1:] {
+		lo, hi = math.Min(lo, s.Value), math.Max(hi, s.Value)
+	}
+
+	const pad = 1 // чтобы линия не обрезалась краем
+	var b strings.Builder
+	for i, s := range samples {
+		x := float64(i) * w / float64(len(samples)-1)
+		y := h / 2
+		if hi > lo {
+			y = pad + (hi-s.Value)/(hi-lo)*(h-2*pad)
+		}
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(strconv.FormatFloat(x, 'f', 1, 64))
+		b.WriteByte(',')
+		b.WriteString(strconv.FormatFloat(y, 'f', 1, 64))
+	}
+	return b.String()
+}
+
+// formatGauge: до 6 знаков после запятой без хвостовых нулей, разряды разделены;
+// очень большие и очень малые значения — в экспоненциальной записи
+func formatGauge(v float64) string {
+	switch abs := math.Abs(v); {
+	case math.IsNaN(v) || math.IsInf(v, 0):
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case abs != 0 && (abs < 1e-4 || abs >= 1e15):
+		return strconv.FormatFloat(v, 'g', 6, 64)
+	}
+	s := strconv.FormatFloat(v, 'f', 6, 64)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		s = "0"
+	}
+	return groupDigits(s)
+}
+
+func formatCounter(v int64) string {
+	return groupDigits(strconv.FormatInt(v, 10))
+}
+
+// groupSep — узкий неразрывный пробел: число не переносится по разрядам
+const groupSep = "\u202f"
+
+// groupDigits разделяет разряды целой части groupSep: 1234567.5 → 1 234 567.5
+func groupDigits(s string) string {
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	intPart, frac, hasFrac := strings.Cut(s, ".")
+	if len(intPart) <= 3 {
+		return sign + s
+	}
+
+	var b strings.Builder
+	b.WriteString(sign)
+	lead := len(intPart) % 3
+	if lead > 0 {
+		b.WriteString(intPart[:lead])
+	}
+	for i := lead; i < len(intPart); i += 3 {
+		if i > 0 {
+			b.WriteString(groupSep)
+		}
+		b.WriteString(intPart[i : i+3])
+	}
+	if hasFrac {
+		b.WriteByte('.')
+		b.WriteString(frac)
+	}
+	return b.String()
+}
@@ -0,0 +1,90 @@
+// Дашборд: поиск по ключу серии, сортировка по клику на заголовок, автообновление без перезагрузки страницы.
+(function () {
+  "use strict";
+
+  const search = document.getElementById("search");
+  const refresh = Number(document.body.dataset.refresh) || 0;
+  const sortState = {}; // id секции → {col, dir}
+
+  function applySearch() {
+    const q = search.value.trim().toLowerCase();
+    document.querySelectorAll("tbody tr[data-series]").forEach(function (tr) {
+      tr.hidden = q !== "" && !tr.dataset.series.toLowerCase().includes(q);
+    });
+  }
+
+  function cellKey(tr, col, kind) {
+    const td = tr.children[col];
+    if (kind === "num") {
+      return Number(td.dataset.value);
+    }
+    return td.textContent;
+  }
+
+  function sortSection(section) {
+    const st = sortState[section.id];
+    if (!st) {
+      return;
+    }
+    const th = section.querySelectorAll("th")[st.col];
+    const kind = th.dataset.sort;
+    const tbody = section.querySelector("tbody");
+    const rows = Array.from(tbody.querySelectorAll("tr[data-series]"));
+    rows.sort(function (a, b) {
+      const x = cellKey(a, st.col, kind);
+      const y = cellKey(b, st.col, kind);
+      let c = kind === "num" ? x - y : x.localeCompare(y);
+      if (c === 0) {
+        c = a.dataset.series.localeCompare(b.dataset.series);
+      }
+      return st.dir === "ascending" ? c : -c;
+    });
+    rows.forEach(function (tr) { tbody.appendChild(tr); });
+    section.querySelectorAll("th").forEach(function (h, i) {
+      if (i === st.col) {
+        h.setAttribute("aria-sort", st.dir);
+      } else {
+        h.removeAttribute("aria-sort");
+      }
+    });
+  }
+
+  // слушаем на document: #tables заменяется при автообновлении
+  document.addEventListener("click", function (e) {
+    const th = e.target.closest("#tables th[data-sort]");
+    if (!th) {
+      return;
+    }
+    const section = th.closest("section");
+    const col = Array.prototype.indexOf.call(th.parentNode.children, th);
+    const prev = sortState[section.id];
+    const dir = prev && prev.col === col && prev.dir === "ascending" ? "descending" : "ascending";
+    sortState[section.id] = { col: col, dir: dir };
+    sortSection(section);
+  });
+
+  search.addEventListener("input", applySearch);
+
+  async function reload() {
+    if (document.hidden) {
+      return;
+    }
+    try {
+      const resp = await fetch(location.href, { headers: { Accept: "text/html" } });
+      if (!resp.ok) {
+        return;
+      }
+      const doc = new DOMParser().parseFromString(await resp.text(), "text/html");
+      document.getElementById("tables").replaceWith(doc.getElementById("tables"));
+      document.getElementById("updated").replaceWith(doc.getElementById("updated"));
+      document.querySelectorAll("#tables section").forEach(sortSection);
+      applySearch();
+    } catch (err) {
+      // сервер недоступен — покажем старые данные и попробуем на следующем тике
+    }
+  }
+
+  if (refresh > 0) {
+    setInterval(reload, refresh * 1000);
+  }
+})();
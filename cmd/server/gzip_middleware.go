@@ -5,6 +5,8 @@ import (
 	"io"
 	"net/http"
 	"strings"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/handler"
 )
 
 type gzipResponseWriter struct {
@@ -28,6 +30,15 @@ func (w *gzipResponseWriter) Write(b []byte) (int, error) {
 	return w.writer.Write(b)
 }
 
+// Flush сбрасывает сжатые данные клиенту — нужен потоковым ответам (SSE)
+func (w *gzipResponseWriter) Flush() {
+	if !w.wroteHeaders {
+		w.WriteHeader(http.StatusOK)
+	}
+	_ = w.writer.Flush()
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
 func gzipResponseMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Проверяем поддержку gzip и нужный тип ответа
@@ -58,7 +69,7 @@ func gzipRequestMiddleware(next http.Handler) http.Handler {
 		if r.Header.Get("Content-Encoding") == "gzip" {
 			gr, err := gzip.NewReader(r.Body)
 			if err != nil {
-				http.Error(w, "failed to read gzip body", http.StatusBadRequest)
+				handler.WriteError(w, http.StatusBadRequest, handler.CodeInvalidBody, "failed to read gzip body")
 				return
 			}
 			defer gr.Close()
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/ingest"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"go.uber.org/zap"
+)
+
+// ingestReceiver — приёмник протокола: разбирает строки и сбрасывает накопленное в хранилище
+type ingestReceiver interface {
+	HandleLine(line string)
+	Flush(ctx context.Context, storage repository.Storage) error
+}
+
+// startStatsD слушает StatsD на addr по UDP и TCP
+func startStatsD(ctx context.Context, storage repository.Storage, addr string, flush time.Duration, wg *sync.WaitGroup) error {
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("statsd udp: %w", err)
+	}
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		udp.Close()
+		return fmt.Errorf("statsd tcp: %w", err)
+	}
+
+	statsd := ingest.NewStatsD()
+	logger.Log.Info("Running StatsD listener", zap.String("address", addr))
+	runIngest(ctx, "statsd", statsd, storage, flush, wg,
+		func(ctx context.Context) error { return ingest.ServeUDP(ctx, udp, statsd.HandleLine) },
+		func(ctx context.Context) error { return ingest.ServeTCP(ctx, tcp, statsd.HandleLine) },
+	)
+	return nil
+}
+
+// startGraphite слушает plaintext-протокол Graphite на addr по TCP
+func startGraphite(ctx context.Context, storage repository.Storage, addr string, counterPrefixes []string, flush time.Duration, wg *sync.WaitGroup) error {
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("graphite tcp: %w", err)
+	}
+
+	graphite := ingest.NewGraphite(counterPrefixes)
+	logger.Log.Info("Running Graphite listener", zap.String("address", addr), zap.Strings("counter_prefixes", counterPrefixes))
+	runIngest(ctx, "graphite", graphite, storage, flush, wg,
+		func(ctx context.Context) error { return ingest.ServeTCP(ctx, tcp, graphite.HandleLine) },
+	)
+	return nil
+}
+
+// runIngest запускает listener'ы приёмника и периодический сброс в storage раз в flush.
+// После отмены ctx listener'ы закрываются, а остаток сбрасывается до wg.Done.
+func runIngest(ctx context.Context, name string, rcv ingestReceiver, storage repository.Storage, flush time.Duration, wg *sync.WaitGroup, serve ...func(context.Context) error) {
+	var listeners sync.WaitGroup
+	for _, s := range serve {
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			if err := s(ctx); err != nil {
+				logger.Log.Error("ingest listener", zap.String("protocol", name), zap.Error(err))
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ingest.RunFlusher(ctx, func(ctx context.Context) error { return rcv.Flush(ctx, storage) }, flush)
+
+		// финальный сброс — после остановки listener'ов, чтобы не потерять последние строки;
+		// ctx уже отменён, поэтому пишем с фоновым контекстом
+		listeners.Wait()
+		if err := rcv.Flush(context.Background(), storage); err != nil {
+			logger.Log.Error("ingest final flush", zap.String("protocol", name), zap.Error(err))
+		}
+	}()
+}
@@ -1,22 +1,31 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/alert"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/grpcapi"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/handler"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/ingest"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/middleware"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/stream"
 	"github.com/go-chi/chi/v5"
-
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
 )
 
@@ -29,29 +38,46 @@ func updateHandler(storage repository.Storage) http.HandlerFunc {
 		valueStr := chi.URLParam(r, "value")
 
 		if name == "" {
-			http.Error(w, "Missing metric name", http.StatusNotFound)
+			handler.WriteError(w, http.StatusNotFound, handler.CodeMissingID, "missing metric name")
 			return
 		}
 
+		m := models.Metrics{ID: name, MType: metricType}
 		switch metricType {
 		case "gauge":
 			value, err := strconv.ParseFloat(valueStr, 64)
 			if err != nil {
-				http.Error(w, "Invalid gauge value", http.StatusBadRequest)
+				handler.WriteError(w, http.StatusBadRequest, handler.CodeInvalidValue, "invalid gauge value")
 				return
 			}
-			storage.UpdateGauge(r.Context(), name, value)
+			m.Value = &value
 
 		case "counter":
 			value, err := strconv.ParseInt(valueStr, 10, 64)
 			if err != nil {
-				http.Error(w, "Invalid counter value", http.StatusBadRequest)
+				handler.WriteError(w, http.StatusBadRequest, handler.CodeInvalidValue, "invalid counter value")
 				return
 			}
-			storage.UpdateCounter(r.Context(), name, value)
+			m.Delta = &value
 
 		default:
-			http.Error(w, "Invalid metric type", http.StatusBadRequest)
+			handler.WriteError(w, http.StatusBadRequest, handler.CodeUnknownType, "invalid metric type")
+			return
+		}
+
+		// те же правила, что у JSON и пакетов: ID без блока меток, gauge — конечное число ("NaN", "Inf" ParseFloat принимает)
+		if e := handler.ValidateMetric(m); e != nil {
+			handler.WriteInvalid(w, e)
+			return
+		}
+		var err error
+		if m.MType == models.Gauge {
+			err = storage.UpdateGauge(r.Context(), name, *m.Value)
+		} else {
+			err = storage.UpdateCounter(r.Context(), name, *m.Delta)
+		}
+		if err != nil {
+			handler.WriteStorageError(w, err)
 			return
 		}
 
@@ -69,25 +95,22 @@ func updateHandlerJSON(storage repository.Storage) http.HandlerFunc {
 		decoder := json.NewDecoder(r.Body)
 		if err := decoder.Decode(&m); err != nil {
 			logger.Log.Debug("cannot decode request JSON body", zap.Error(err))
-			http.Error(w, "bad request", http.StatusBadRequest)
+			handler.WriteError(w, http.StatusBadRequest, handler.CodeInvalidJSON, "invalid json: "+err.Error())
+			return
+		}
+		if e := handler.ValidateMetric(m); e != nil {
+			handler.WriteInvalid(w, e)
 			return
 		}
 
-		switch m.MType {
-		case "gauge":
-			if m.Value == nil {
-				http.Error(w, "missing gauge value", http.StatusBadRequest)
-				return
-			}
-			storage.UpdateGauge(r.Context(), m.ID, *m.Value)
-		case "counter":
-			if m.Delta == nil {
-				http.Error(w, "missing counter delta", http.StatusBadRequest)
-				return
-			}
-			storage.UpdateCounter(r.Context(), m.ID, *m.Delta)
-		default:
-			http.Error(w, "unknown metric type", http.StatusNotImplemented)
+		var err error
+		if m.MType == models.Gauge {
+			err = storage.UpdateGauge(r.Context(), m.SeriesID(), *m.Value)
+		} else {
+			err = storage.UpdateCounter(r.Context(), m.SeriesID(), *m.Delta)
+		}
+		if err != nil {
+			handler.WriteStorageError(w, err)
 			return
 		}
 
@@ -103,94 +126,98 @@ func valueHandlerJSON(storage repository.Storage) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var m models.Metrics
 		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
-			http.Error(w, "bad request", http.StatusBadRequest)
+			handler.WriteError(w, http.StatusBadRequest, handler.CodeInvalidJSON, "invalid json: "+err.Error())
+			return
+		}
+		if e := handler.ValidateMetricKey(m); e != nil {
+			handler.WriteInvalid(w, e)
 			return
 		}
 
 		//w.Header().Set("Content-Type", "application/json")
 		switch m.MType {
 		case "gauge":
-			val, ok := storage.GetGauge(r.Context(), m.ID)
-			if !ok {
-				http.Error(w, "not found", http.StatusNotFound)
+			val, err := storage.GetGauge(r.Context(), m.SeriesID())
+			if err != nil {
+				handler.WriteStorageError(w, err)
 				return
 			}
 			m.Value = &val
 		case "counter":
-			val, ok := storage.GetCounter(r.Context(), m.ID)
-			if !ok {
-				http.Error(w, "not found", http.StatusNotFound)
+			val, err := storage.GetCounter(r.Context(), m.SeriesID())
+			if err != nil {
+				handler.WriteStorageError(w, err)
 				return
 			}
 			m.Delta = &val
-		default:
-			http.Error(w, "unknown metric type", http.StatusNotImplemented)
-			return
 		}
 
 		_ = handler.WriteSignedJSONResponse(w, m, flagKey)
 	}
 }
 
-// GET /value/{type}/{name}
+// GET /value/{type}/{name}[?label=host=a&label=...] — метки задают конкретную серию
 func valueHandler(storage repository.Storage) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		metricType := chi.URLParam(r, "type")
-		name := chi.URLParam(r, "name")
+		labels, err := models.ParseLabelFilter(r.URL.Query()["label"])
+		if err != nil {
+			handler.WriteError(w, http.StatusBadRequest, handler.CodeInvalidLabels, "invalid label filter")
+			return
+		}
+		id := chi.URLParam(r, "name")
+		if err := models.ValidateID(id); err != nil {
+			handler.WriteError(w, http.StatusBadRequest, handler.CodeInvalidID, err.Error())
+			return
+		}
+		name := models.SeriesID(id, labels)
 
 		switch metricType {
 		case "gauge":
-			val, ok := storage.GetGauge(r.Context(), name)
-			if !ok {
-				http.Error(w, "not found", http.StatusNotFound)
+			val, err := storage.GetGauge(r.Context(), name)
+			if err != nil {
+				handler.WriteStorageError(w, err)
 				return
 			}
 			w.WriteHeader(http.StatusOK)
 			fmt.Fprint(w, strconv.FormatFloat(val, 'f', -1, 64))
 
 		case "counter":
-			val, ok := storage.GetCounter(r.Context(), name)
-			if !ok {
-				http.Error(w, "not found", http.StatusNotFound)
+			val, err := storage.GetCounter(r.Context(), name)
+			if err != nil {
+				handler.WriteStorageError(w, err)
 				return
 			}
 			w.WriteHeader(http.StatusOK)
 			fmt.Fprintf(w, "%d", val)
 
 		default:
-			http.Error(w, "invalid metric type", http.StatusBadRequest)
+			handler.WriteError(w, http.StatusBadRequest, handler.CodeUnknownType, "invalid metric type")
 		}
 	}
 }
 
-// GET /
-func indexHandler(storage repository.Storage) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		gauges, counters := storage.GetAllMetrics(r.Context())
-
-		w.Header().Set("Content-Type", "text/html")
-		w.WriteHeader(http.StatusOK)
-
-		fmt.Fprintln(w, "<html><body><h1>Metrics</h1><ul>")
-		for name, val := range gauges {
-			fmt.Fprintf(w, "<li>gauge %s = %f</li>\n", name, val)
-		}
-		for name, val := range counters {
-			fmt.Fprintf(w, "<li>counter %s = %d</li>\n", name, val)
+// filterSeries оставляет в карте только серии, метки которых содержат все пары из filter
+func filterSeries[V any](series map[string]V, filter models.Labels) {
+	if len(filter) == 0 {
+		return
+	}
+	for key := range series {
+		if _, labels := models.ParseSeriesID(key); !labels.Match(filter) {
+			delete(series, key)
 		}
-		fmt.Fprintln(w, "</ul></body></html>")
 	}
 }
 
-// GET /
-func pingHandler(db *sql.DB) http.HandlerFunc {
+// GET /ping
+func pingHandler(pool *pgxpool.Pool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if db == nil {
-			http.Error(w, "DB not configured", http.StatusInternalServerError)
+		if pool == nil {
+			handler.WriteError(w, http.StatusInternalServerError, handler.CodeStorage, "DB not configured")
 			return
 		}
-		if err := db.PingContext(r.Context()); err != nil {
-			http.Error(w, "DB not available", http.StatusInternalServerError)
+		if err := pool.Ping(r.Context()); err != nil {
+			handler.WriteError(w, http.StatusInternalServerError, handler.CodeStorage, "DB not available")
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -198,24 +225,39 @@ func pingHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func initPostgres(dsn string) (*sql.DB, error) {
+func initPostgres(ctx context.Context, dsn string) (*pgxpool.Pool, error) {
 	if dsn == "" {
 		return nil, nil // режим без БД
 	}
 
-	db, err := sql.Open("pgx", dsn)
+	pool, err := repository.NewPool(ctx, dsn, repository.PoolConfig{
+		MaxConns:         int32(flagDBMaxConns),
+		MinConns:         int32(flagDBMinConns),
+		MaxConnLifetime:  flagDBConnLifetime,
+		MaxConnIdleTime:  flagDBConnIdleTime,
+		StatementTimeout: flagDBStatementTimeout,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to open DB: %w", err)
+		return nil, fmt.Errorf("failed to connect to DB: %w", err)
 	}
-	if err = db.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to ping DB: %w", err)
-	}
-	logger.Log.Info("Connected to PostgreSQL successfully")
-	return db, nil
+	logger.Log.Info("Connected to PostgreSQL successfully",
+		zap.Int32("max_conns", pool.Config().MaxConns), zap.Int32("min_conns", pool.Config().MinConns))
+	return pool, nil
 }
 
 func main() {
 
+	// `server migrate ...` управляет версией схемы и завершается, не запуская сервер
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := runMigrate(ctx, os.Args[2:], os.Stdout)
+		stop()
+		if err != nil {
+			log.Fatalf("Migrate failed: %v", err)
+		}
+		return
+	}
+
 	// обрабатываем аргументы командной строки
 	parseFlags()
 
@@ -232,22 +274,34 @@ func run() error {
 		return err
 	}
 
-	db, err := initPostgres(flagDatabaseDSN)
+	// контекст отменяется по SIGINT/SIGTERM — по нему останавливаются все фоновые задачи
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db, err := initPostgres(ctx, flagDatabaseDSN)
 	if err != nil {
 		return err
 	}
 
 	if db != nil {
-		if err := repository.RunMigrations(flagDatabaseDSN); err != nil {
+		if err := repository.RunMigrations(ctx, flagDatabaseDSN); err != nil {
 			return fmt.Errorf("failed to run migrations: %w", err)
 		}
 	}
 
 	var storage repository.Storage
 	if db != nil {
-		storage = repository.NewPostgresStorage(db)
+		pgStorage := repository.NewPostgresStorage(db)
+		if flagHistory {
+			pgStorage.EnableHistory()
+		}
+		storage = pgStorage
 	} else {
-		storage = repository.NewMemStorage()
+		memStorage := repository.NewMemStorage()
+		if flagHistory {
+			memStorage.EnableHistory(flagHistorySize)
+		}
+		storage = memStorage
 	}
 
 	// загружаем метрики из файла, если включено
@@ -257,9 +311,81 @@ func run() error {
 		}
 	}
 
-	// запуск периодического сохранения, если установлен интервал > 0
+	// запуск периодического сохранения, если установлен интервал > 0;
+	// storeDone закрывается, когда PeriodicStore завершился и больше не пишет файл
+	storeDone := make(chan struct{})
 	if memStorage, ok := storage.(*repository.MemStorage); ok && flagStoreInterval > 0 && flagFileStoragePath != "" {
-		go memStorage.PeriodicStore(flagFileStoragePath, time.Duration(flagStoreInterval)*time.Second)
+		go func() {
+			defer close(storeDone)
+			memStorage.PeriodicStore(ctx, flagFileStoragePath, time.Duration(flagStoreInterval)*time.Second)
+		}()
+	} else {
+		close(storeDone)
+	}
+
+	// фоновые задачи по хранилищу (retention, алерты) завершаются по ctx до финального сохранения
+	var backgroundWG sync.WaitGroup
+
+	// прореживание истории по политике хранения
+	if flagHistory && flagRetentionRaw > 0 {
+		levels, err := repository.ParseRollupLevels(flagRetentionRollups)
+		if err != nil {
+			return fmt.Errorf("invalid retention rollups: %w", err)
+		}
+		if flagRetentionInterval <= 0 {
+			return fmt.Errorf("retention interval must be positive")
+		}
+		policy := repository.RetentionPolicy{Raw: flagRetentionRaw, Levels: levels}
+		if retainer, ok := storage.(repository.Retainer); ok {
+			backgroundWG.Add(1)
+			go func() {
+				defer backgroundWG.Done()
+				repository.RunRetention(ctx, retainer, policy, flagRetentionInterval)
+			}()
+		}
+	}
+
+	// правила алертов вычисляются по хранилищу, уведомления уходят в webhook'и из файла правил
+	var alerts *alert.Engine
+	if flagAlertRules != "" {
+		cfg, err := alert.LoadConfig(flagAlertRules)
+		if err != nil {
+			return err
+		}
+		alerts = alert.NewEngine(storage, cfg.Rules)
+		backgroundWG.Add(1)
+		go func() {
+			defer backgroundWG.Done()
+			alerts.Run(ctx, time.Duration(cfg.Interval), alert.NewNotifier(cfg.Webhooks))
+		}()
+		logger.Log.Info("Alert rules loaded", zap.Int("rules", len(cfg.Rules)), zap.Int("webhooks", len(cfg.Webhooks)))
+	}
+
+	// все пути записи публикуют принятые обновления подписчикам /api/v1/stream
+	hub := stream.NewHub(flagStreamBuffer)
+	writer := stream.NewPublishingStorage(storage, hub)
+
+	// приём метрик по сторонним протоколам; listener'ы останавливаются по ctx и сбрасывают остаток до ingestWG.Done
+	var ingestWG sync.WaitGroup
+	if (flagStatsDAddr != "" || flagGraphiteAddr != "") && flagIngestFlush <= 0 {
+		return fmt.Errorf("ingest flush interval must be positive")
+	}
+	if flagStatsDAddr != "" {
+		if err := startStatsD(ctx, writer, flagStatsDAddr, flagIngestFlush, &ingestWG); err != nil {
+			return err
+		}
+	}
+	if flagGraphiteAddr != "" {
+		prefixes := ingest.ParseList(flagGraphiteCounters)
+		if err := startGraphite(ctx, writer, flagGraphiteAddr, prefixes, flagIngestFlush, &ingestWG); err != nil {
+			return err
+		}
+	}
+
+	// история метрик доступна только в режиме -history: /api/v1/query_range и спарклайны дашборда
+	var historyReader repository.HistoryReader
+	if hr, ok := storage.(repository.HistoryReader); ok && flagHistory {
+		historyReader = hr
 	}
 
 	r := chi.NewRouter()
@@ -270,27 +396,75 @@ func run() error {
 	r.Use(gzipRequestMiddleware)
 	r.Use(gzipResponseMiddleware)
 
-	r.Post("/update/{type}/{name}/{value}", updateHandler(storage)) // Регистрируем маршрут с параметрами
+	r.Post("/update/{type}/{name}/{value}", updateHandler(writer)) // Регистрируем маршрут с параметрами
 
 	hashMiddleware := middleware.ValidateHashSHA256(flagKey)
 
-	r.With(hashMiddleware).Post("/update", updateHandlerJSON(storage))
-	r.With(hashMiddleware).Post("/update/", updateHandlerJSON(storage))
+	r.With(hashMiddleware).Post("/update", updateHandlerJSON(writer))
+	r.With(hashMiddleware).Post("/update/", updateHandlerJSON(writer))
 
-	r.With(hashMiddleware).Post("/updates", handler.UpdatesHandler(storage, flagKey))
-	r.With(hashMiddleware).Post("/updates/", handler.UpdatesHandler(storage, flagKey))
+	r.With(hashMiddleware).Post("/updates", handler.UpdatesHandler(writer, flagKey))
+	r.With(hashMiddleware).Post("/updates/", handler.UpdatesHandler(writer, flagKey))
 
 	r.Post("/value", valueHandlerJSON(storage))
 	r.Post("/value/", valueHandlerJSON(storage))
 
 	r.Get("/value/{type}/{name}", valueHandler(storage))
-	r.Get("/", indexHandler(storage))
+	r.Get("/", dashboardHandler(storage, historyReader))
+	r.Handle("/assets/*", dashboardAssets())
+	r.Get("/metrics", prometheusHandler(storage)) // экспозиция для Prometheus
+
+	r.Mount("/api/v1", apiV1Router(apiDeps{
+		reader:  storage,
+		writer:  writer,
+		key:     flagKey,
+		hub:     hub,
+		history: historyReader,
+		alerts:  alerts,
+		persist: snapshotFunc(storage, flagFileStoragePath),
+	}))
+
+	// InfluxDB line protocol (Telegraf и др.)
+	r.Post("/api/v2/write", handler.InfluxWriteHandler(writer, ingest.ParseList(flagInfluxCounters)))
 
 	if db != nil {
 		r.Get("/ping", pingHandler(db)) //проверяет соединение с базой данных.
 	}
 
+	ln, err := net.Listen("tcp", flagRunAddr)
+	if err != nil {
+		return err
+	}
+
 	logger.Log.Info("Running server", zap.String("address", flagRunAddr))
 
-	return http.ListenAndServe(flagRunAddr, r)
+	// gRPC-сервис на отдельном порту поверх того же хранилища
+	grpcDone := make(chan error, 1)
+	if flagGRPCAddr != "" {
+		gln, err := net.Listen("tcp", flagGRPCAddr)
+		if err != nil {
+			ln.Close()
+			return fmt.Errorf("grpc listen: %w", err)
+		}
+		logger.Log.Info("Running gRPC server", zap.String("address", flagGRPCAddr))
+		go func() {
+			grpcDone <- serveGRPC(ctx, grpcapi.NewGRPCServer(writer, flagKey), gln, flagShutdownTimeout)
+		}()
+	} else {
+		grpcDone <- nil
+	}
+
+	srv := &http.Server{Handler: r}
+	srv.RegisterOnShutdown(hub.Close) // открытые SSE-потоки не должны держать остановку
+	serveErr := serve(ctx, srv, ln, flagShutdownTimeout)
+
+	// если сервер упал сам, ctx ещё не отменён — останавливаем gRPC и listener'ы явно
+	stop()
+	grpcErr := <-grpcDone
+	ingestWG.Wait()
+	backgroundWG.Wait()
+	<-storeDone
+
+	// сервер остановлен — сохраняем всё, что пришло после последнего тика PeriodicStore
+	return errors.Join(serveErr, grpcErr, flushOnShutdown(storage, flagFileStoragePath, db))
 }
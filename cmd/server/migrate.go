@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+)
+
+const migrateUsage = "usage: server migrate [-d DSN] status | up | down N | force VERSION"
+
+// migrateCmd — разобранная команда `server migrate`
+type migrateCmd struct {
+	dsn    string
+	action string // status, up, down, force
+	n      int    // число шагов для down или версия для force
+}
+
+// parseMigrateArgs разбирает аргументы после `migrate`; DATABASE_DSN из окружения имеет приоритет над -d
+func parseMigrateArgs(args []string) (migrateCmd, error) {
+	var cmd migrateCmd
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&cmd.dsn, "d", "", "database DSN")
+	if err := fs.Parse(args); err != nil {
+		return cmd, fmt.Errorf("%w\n%s", err, migrateUsage)
+	}
+	if dsn, ok := os.LookupEnv("DATABASE_DSN"); ok && dsn != "" {
+		cmd.dsn = dsn
+	}
+	if cmd.dsn == "" {
+		return cmd, errors.New("database DSN is required (-d or DATABASE_DSN)")
+	}
+
+	rest := fs.Args()
+	if len(rest) == 0 {
+		return cmd, errors.New(migrateUsage)
+	}
+	cmd.action = rest[0]
+	switch cmd.action {
+	case "status", "up":
+		if len(rest) != 1 {
+			return cmd, errors.New(migrateUsage)
+		}
+	case "down", "force":
+		if len(rest) != 2 {
+			return cmd, errors.New(migrateUsage)
+		}
+		n, err := strconv.Atoi(rest[1])
+		if err != nil {
+			return cmd, fmt.Errorf("%s: invalid number %q", cmd.action, rest[1])
+		}
+		if cmd.action == "down" && n <= 0 {
+			return cmd, fmt.Errorf("down: number of migrations must be positive, got %d", n)
+		}
+		// force -1 — допустимое значение golang-migrate: «миграции не применялись»
+		if cmd.action == "force" && n < -1 {
+			return cmd, fmt.Errorf("force: invalid version %d", n)
+		}
+		cmd.n = n
+	default:
+		return cmd, fmt.Errorf("unknown migrate command %q\n%s", cmd.action, migrateUsage)
+	}
+	return cmd, nil
+}
+
+// runMigrate выполняет `server migrate ...` и печатает состояние схемы в out
+func runMigrate(ctx context.Context, args []string, out io.Writer) error {
+	cmd, err := parseMigrateArgs(args)
+	if err != nil {
+		return err
+	}
+
+	mg, err := repository.OpenMigrator(ctx, cmd.dsn)
+	if err != nil {
+		return err
+	}
+	defer mg.Close()
+
+	switch cmd.action {
+	case "up":
+		err = mg.Up()
+	case "down":
+		err = mg.Down(cmd.n)
+	case "force":
+		err = mg.Force(cmd.n)
+	}
+	if err != nil {
+		return err
+	}
+
+	st, err := mg.Status()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "version: %d\ndirty: %t\nlatest: %d\npending: %d\n", st.Version, st.Dirty, st.Latest, st.Pending)
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/handler"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"go.uber.org/zap"
+)
+
+// Content-Type текстового формата экспозиции Prometheus
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// sanitizeMetricName приводит имя метрики к виду [a-zA-Z_:][a-zA-Z0-9_:]*,
+// заменяя недопустимые символы на "_".
+func sanitizeMetricName(name string) string {
+	if name == "" {
+		return "_"
+	}
+	var b strings.Builder
+	b.Grow(len(name) + 1)
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_') // имя не может начинаться с цифры
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// formatPromFloat форматирует значение так, как его ожидает Prometheus (NaN, +Inf, -Inf)
+func formatPromFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// promSeries — одна серия в выводе: санитизированное имя семейства, метки и значение
+type promSeries struct {
+	family string
+	labels string
+	value  string
+}
+
+// GET /metrics[?label=host=a&label=...] — все метрики в текстовом формате Prometheus
+func prometheusHandler(storage repository.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := models.ParseLabelFilter(r.URL.Query()["label"])
+		if err != nil {
+			handler.WriteError(w, http.StatusBadRequest, handler.CodeInvalidLabels, "invalid label filter")
+			return
+		}
+		gauges, counters, err := storage.GetAllMetrics(r.Context())
+		if err != nil {
+			handler.WriteStorageError(w, err)
+			return
+		}
+		filterSeries(gauges, filter)
+		filterSeries(counters, filter)
+
+		var buf bytes.Buffer
+		// семейство (имя после санитайзинга) может принадлежать только одному типу
+		familyType := make(map[string]string, len(gauges)+len(counters))
+		// после санитайзинга разные исходные имена могут совпасть — выводим только первую серию
+		seen := make(map[string]struct{}, len(gauges)+len(counters))
+
+		writeFamilies := func(mtype string, series []promSeries) {
+			sort.Slice(series, func(i, j int) bool {
+				if series[i].family != series[j].family {
+					return series[i].family < series[j].family
+				}
+				return series[i].labels < series[j].labels
+			})
+			for i, s := range series {
+				if t, ok := familyType[s.family]; ok && t != mtype {
+					logger.Log.Debug("prometheus family type conflict, series skipped", zap.String("name", s.family))
+					continue
+				}
+				if _, ok := seen[s.family+s.labels]; ok {
+					logger.Log.Debug("duplicate prometheus series skipped", zap.String("name", s.family+s.labels))
+					continue
+				}
+				seen[s.family+s.labels] = struct{}{}
+				if i == 0 || series[i-1].family != s.family {
+					familyType[s.family] = mtype
+					buf.WriteString("# TYPE " + s.family + " " + mtype + "\n")
+				}
+				buf.WriteString(s.family + s.labels + " " + s.value + "\n")
+			}
+		}
+
+		gaugeSeries := make([]promSeries, 0, len(gauges))
+		for key, val := range gauges {
+			id, labels := models.ParseSeriesID(key)
+			gaugeSeries = append(gaugeSeries, promSeries{sanitizeMetricName(id), labels.String(), formatPromFloat(val)})
+		}
+		writeFamilies("gauge", gaugeSeries)
+
+		counterSeries := make([]promSeries, 0, len(counters))
+		for key, val := range counters {
+			id, labels := models.ParseSeriesID(key)
+			counterSeries = append(counterSeries, promSeries{sanitizeMetricName(id), labels.String(), strconv.FormatInt(val, 10)})
+		}
+		writeFamilies("counter", counterSeries)
+
+		w.Header().Set("Content-Type", prometheusContentType)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(buf.Bytes())
+	}
+}
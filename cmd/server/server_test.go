@@ -1,18 +1,29 @@
 package main
 
 import (
+	"bufio"
 	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/cryptohelpers"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/handler"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/stream"
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestUpdateHandler_TableDriven(t *testing.T) {
@@ -29,8 +40,8 @@ func TestUpdateHandler_TableDriven(t *testing.T) {
 			url:        "/update/gauge/testGauge/42.5",
 			wantStatus: http.StatusOK,
 			check: func(t *testing.T, storage *repository.MemStorage) {
-				val, ok := storage.GetGauge(context.Background(), "testGauge")
-				assert.True(t, ok)
+				val, err := storage.GetGauge(context.Background(), "testGauge")
+				assert.NoError(t, err)
 				assert.Equal(t, 42.5, val)
 			},
 		},
@@ -40,8 +51,8 @@ func TestUpdateHandler_TableDriven(t *testing.T) {
 			url:        "/update/counter/testCounter/5",
 			wantStatus: http.StatusOK,
 			check: func(t *testing.T, storage *repository.MemStorage) {
-				val, ok := storage.GetCounter(context.Background(), "testCounter")
-				assert.True(t, ok)
+				val, err := storage.GetCounter(context.Background(), "testCounter")
+				assert.NoError(t, err)
 				assert.Equal(t, int64(5), val)
 			},
 		},
@@ -127,26 +138,108 @@ func TestGetValueHandler(t *testing.T) {
 }
 
 func TestHTMLHandler(t *testing.T) {
+	ctx := context.Background()
 	storage := repository.NewMemStorage()
-	storage.UpdateGauge(context.Background(), "myGauge", 1.23)
-	storage.UpdateCounter(context.Background(), "myCounter", 99)
+	storage.EnableHistory(100)
+	storage.UpdateGauge(ctx, "myGauge", 1.23)
+	storage.UpdateGauge(ctx, "Alloc", 1234567.5)
+	storage.UpdateGauge(ctx, `bad<script>alert(1)</script>`, 0)
+	storage.UpdateCounter(ctx, "myCounter", 99)
+	for _, v := range []float64{1, 3, 2} {
+		storage.UpdateGauge(ctx, models.SeriesID("Load1", models.Labels{"host": "a"}), v)
+	}
 
 	r := chi.NewRouter()
-	r.Get("/", indexHandler(storage))
+	r.Get("/", dashboardHandler(storage, storage))
+	r.Handle("/assets/*", dashboardAssets())
 
-	req := httptest.NewRequest(http.MethodGet, "/", nil)
-	w := httptest.NewRecorder()
-	r.ServeHTTP(w, req)
+	get := func(url string) (*http.Response, string) {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		resp := w.Result()
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
 
-	resp := w.Result()
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
+	resp, body := get("/")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Contains(t, body, ">1.23<")
+	assert.NotContains(t, body, "1.230000")
+	assert.Contains(t, body, ">1\u202f234\u202f567.5<")
+	assert.Contains(t, body, `data-value="1234567.5"`)
+	assert.Contains(t, body, ">99<")
+	assert.NotContains(t, body, "<script>alert(1)")
+	assert.Contains(t, body, "&lt;script&gt;")
 
+	// строки отсортированы по ключу серии, порядок не меняется между запросами
+	alloc, load, my := strings.Index(body, ">Alloc<"), strings.Index(body, ">Load1<"), strings.Index(body, ">myGauge<")
+	assert.True(t, alloc < load && load < my, "rows must be sorted")
+	_, again := get("/")
+	assert.Equal(t, body, again)
+
+	// с историей появляется колонка спарклайнов
+	assert.Contains(t, body, "Last 15 min")
+	assert.Contains(t, body, `host=&#34;a&#34;`)
+
+	_, body = get("/?label=host=a&refresh=0")
+	assert.Contains(t, body, ">Load1<")
+	assert.NotContains(t, body, ">Alloc<")
+	assert.Contains(t, body, `data-refresh="0"`)
+
+	resp, _ = get("/?refresh=-1")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, body = get("/assets/dashboard.js")
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
-	assert.Contains(t, string(body), "myGauge")
-	assert.Contains(t, string(body), "1.230")
-	assert.Contains(t, string(body), "myCounter")
-	assert.Contains(t, string(body), "99")
+	assert.Contains(t, body, "setInterval")
+}
+
+// countingHistory считает запросы истории
+type countingHistory struct {
+	repository.HistoryReader
+	queries atomic.Int64
+}
+
+func (h *countingHistory) QueryRange(ctx context.Context, mtype, name string, from, to time.Time, step time.Duration) ([]repository.Sample, error) {
+	h.queries.Add(1)
+	return h.HistoryReader.QueryRange(ctx, mtype, name, from, to, step)
+}
+
+// Автообновление не запрашивает историю каждой серии заново, число спарклайнов ограничено
+func TestDashboardSparklinesCached(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	storage.EnableHistory(100)
+	for i := range maxSparklines + 5 {
+		storage.UpdateGauge(ctx, fmt.Sprintf("g%03d", i), float64(i))
+	}
+	history := &countingHistory{HistoryReader: storage}
+	h := dashboardHandler(storage, history)
+
+	for range 3 {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	assert.Equal(t, int64(maxSparklines), history.queries.Load())
+}
+
+func TestFormatGauge(t *testing.T) {
+	for v, want := range map[float64]string{
+		0:          "0",
+		1.23:       "1.23",
+		-1234.5:    "-1\u202f234.5",
+		0.1 + 0.2:  "0.3",
+		123456789:  "123\u202f456\u202f789",
+		0.00001234: "1.234e-05",
+		1e20:       "1e+20",
+	} {
+		assert.Equal(t, want, formatGauge(v), v)
+	}
+	assert.Equal(t, "-9\u202f000", formatCounter(-9000))
 }
 
 func TestUpdateHandlerJSON(t *testing.T) {
@@ -164,9 +257,9 @@ func TestUpdateHandlerJSON(t *testing.T) {
 			input:      `{"id":"TestGauge","type":"gauge","value":123.456}`,
 			wantStatus: http.StatusOK,
 			check: func() error {
-				v, ok := storage.GetGauge(context.Background(), "TestGauge")
-				if !ok || v != 123.456 {
-					return fmt.Errorf("expected 123.456, got %v (ok=%v)", v, ok)
+				v, err := storage.GetGauge(context.Background(), "TestGauge")
+				if err != nil || v != 123.456 {
+					return fmt.Errorf("expected 123.456, got %v (err=%v)", v, err)
 				}
 				return nil
 			},
@@ -176,9 +269,9 @@ func TestUpdateHandlerJSON(t *testing.T) {
 			input:      `{"id":"TestCounter","type":"counter","delta":5}`,
 			wantStatus: http.StatusOK,
 			check: func() error {
-				v, ok := storage.GetCounter(context.Background(), "TestCounter")
-				if !ok || v != 5 {
-					return fmt.Errorf("expected 5, got %v (ok=%v)", v, ok)
+				v, err := storage.GetCounter(context.Background(), "TestCounter")
+				if err != nil || v != 5 {
+					return fmt.Errorf("expected 5, got %v (err=%v)", v, err)
 				}
 				return nil
 			},
@@ -192,7 +285,7 @@ func TestUpdateHandlerJSON(t *testing.T) {
 		{
 			name:       "unknown type",
 			input:      `{"id":"BadType","type":"other","value":1.23}`,
-			wantStatus: http.StatusNotImplemented,
+			wantStatus: http.StatusBadRequest,
 			check:      func() error { return nil },
 		},
 	}
@@ -300,8 +393,8 @@ func TestUpdateHandlerJSON_GzipRequest(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, res.StatusCode)
 
-	v, ok := storage.GetGauge(context.Background(), "GZGauge")
-	assert.True(t, ok)
+	v, err := storage.GetGauge(context.Background(), "GZGauge")
+	assert.NoError(t, err)
 	assert.Equal(t, 3.14, v)
 }
 
@@ -340,3 +433,687 @@ func TestValueHandlerJSON_GzipResponse(t *testing.T) {
 
 	assert.Contains(t, string(uncompressed), `"value":2.718`)
 }
+
+// /api/v1 и старые маршруты отвечают ошибками в одном формате; для пакета указывается номер метрики
+func TestAPIV1Errors(t *testing.T) {
+	storage := repository.NewMemStorage()
+	r := chi.NewRouter()
+	r.Post("/update", updateHandlerJSON(storage))
+	r.Post("/update/{type}/{name}/{value}", updateHandler(storage))
+	r.Mount("/api/v1", apiV1Router(apiDeps{reader: storage, writer: storage, hub: stream.NewHub(1)}))
+
+	do := func(method, url, body string) (int, handler.ErrorResponse) {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		var er handler.ErrorResponse
+		if res.StatusCode >= 400 {
+			assert.Equal(t, "application/json", res.Header.Get("Content-Type"), url)
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&er), url)
+		}
+		return res.StatusCode, er
+	}
+
+	status, _ := do(http.MethodPost, "/api/v1/update", `{"id":"Alloc","type":"gauge","value":1.5}`)
+	assert.Equal(t, http.StatusOK, status)
+	v, err := storage.GetGauge(context.Background(), "Alloc")
+	assert.NoError(t, err)
+	assert.Equal(t, 1.5, v)
+
+	tests := []struct {
+		name, method, url, body string
+		status                  int
+		code                    string
+		index                   *int
+	}{
+		{"bad json", http.MethodPost, "/api/v1/update", `{"id":`, 400, handler.CodeInvalidJSON, nil},
+		{"unknown type", http.MethodPost, "/api/v1/update", `{"id":"X","type":"histogram","value":1}`, 400, handler.CodeUnknownType, nil},
+		{"unknown type legacy", http.MethodPost, "/update", `{"id":"X","type":"histogram","value":1}`, 400, handler.CodeUnknownType, nil},
+		{"missing value", http.MethodPost, "/api/v1/update", `{"id":"X","type":"counter"}`, 400, handler.CodeMissingValue, nil},
+		{"missing id", http.MethodPost, "/api/v1/update", `{"type":"gauge","value":1}`, 400, handler.CodeMissingID, nil},
+		{"invalid value legacy", http.MethodPost, "/update/counter/X/1.5", ``, 400, handler.CodeInvalidValue, nil},
+		{"nan gauge legacy", http.MethodPost, "/update/gauge/X/NaN", ``, 400, handler.CodeInvalidValue, nil},
+		{"inf gauge legacy", http.MethodPost, "/update/gauge/X/-Inf", ``, 400, handler.CodeInvalidValue, nil},
+		{"labels in id", http.MethodPost, "/api/v1/update", `{"id":"Alloc{a=\"b\"}","type":"gauge","value":1}`, 400, handler.CodeInvalidID, nil},
+		{"labels in id legacy", http.MethodPost, "/update/gauge/Alloc%7Ba=%22b%22%7D/1", ``, 400, handler.CodeInvalidID, nil},
+		{"labels in id read", http.MethodPost, "/api/v1/value", `{"id":"Alloc{","type":"gauge"}`, 400, handler.CodeInvalidID, nil},
+		{"batch item", http.MethodPost, "/api/v1/updates",
+			`[{"id":"A","type":"gauge","value":1},{"id":"B","type":"histogram","value":2}]`, 400, handler.CodeUnknownType, intPtr(1)},
+		{"empty batch", http.MethodPost, "/api/v1/updates", `[]`, 400, handler.CodeEmptyBatch, nil},
+		{"not found", http.MethodPost, "/api/v1/value", `{"id":"Nope","type":"gauge"}`, 404, handler.CodeNotFound, nil},
+		{"unknown route", http.MethodGet, "/api/v1/nope", ``, 404, handler.CodeNotFound, nil},
+		{"wrong method", http.MethodGet, "/api/v1/update", ``, 405, handler.CodeMethodNotAllowed, nil},
+		{"history disabled", http.MethodGet, "/api/v1/query_range?id=Alloc", ``, 404, handler.CodeNotFound, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, er := do(tt.method, tt.url, tt.body)
+			assert.Equal(t, tt.status, status)
+			assert.Equal(t, tt.code, er.Error.Code)
+			assert.NotEmpty(t, er.Error.Message)
+			assert.Equal(t, tt.index, er.Error.Index)
+		})
+	}
+
+	// отклонённый пакет не записывается даже частично
+	_, err = storage.GetGauge(context.Background(), "A")
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+}
+
+// Результат проверки пакета одинаков для хранилища с UpdateBatch и для поштучной записи
+func TestUpdatesBatchValidation(t *testing.T) {
+	const body = `[
+		{"id":"Alloc","type":"gauge","value":1},
+		{"id":"","type":"gauge","value":2},
+		{"id":"Alloc","type":"gauge","value":3},
+		{"id":"PollCount","type":"counter","delta":2},
+		{"id":"PollCount","type":"counter","delta":3},
+		{"id":"Heap","type":"gauge"},
+		{"id":"Other","type":"summary","value":1}
+	]`
+
+	backends := map[string]func(*repository.MemStorage) repository.Storage{
+		"batch updater": func(s *repository.MemStorage) repository.Storage { return s },
+		// без UpdateBatch запись идёт поштучно
+		"plain storage": func(s *repository.MemStorage) repository.Storage { return struct{ repository.Storage }{s} },
+	}
+	for name, wrap := range backends {
+		t.Run(name, func(t *testing.T) {
+			mem := repository.NewMemStorage()
+			h := handler.UpdatesHandler(wrap(mem), "")
+			post := func(url string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, url, strings.NewReader(body)))
+				return w
+			}
+
+			// по умолчанию пакет отклоняется целиком, в ответе все некорректные метрики
+			w := post("/updates")
+			require.Equal(t, http.StatusBadRequest, w.Code)
+			var er handler.ErrorResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&er))
+			assert.Equal(t, handler.CodeMissingID, er.Error.Code)
+			assert.Equal(t, intPtr(1), er.Error.Index)
+			require.Len(t, er.Items, 3)
+			assert.Equal(t, []int{1, 5, 6}, []int{er.Items[0].Index, er.Items[1].Index, er.Items[2].Index})
+			assert.Equal(t, handler.CodeUnknownType, er.Items[2].Error.Code)
+			gauges, counters, err := mem.GetAllMetrics(context.Background())
+			require.NoError(t, err)
+			assert.Empty(t, gauges)
+			assert.Empty(t, counters)
+
+			w = post("/updates?partial=true")
+			require.Equal(t, http.StatusOK, w.Code)
+			var report handler.BatchReport
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+			assert.Equal(t, 3, report.Accepted)
+			assert.Equal(t, 3, report.Rejected)
+			assert.Equal(t, 1, report.Duplicates)
+			statuses := make([]string, 0, len(report.Items))
+			for _, item := range report.Items {
+				statuses = append(statuses, item.Status)
+			}
+			assert.Equal(t, []string{"duplicate", "rejected", "accepted", "accepted", "accepted", "rejected", "rejected"}, statuses)
+			assert.Equal(t, handler.CodeMissingValue, report.Items[5].Error.Code)
+
+			v, _ := mem.GetGauge(context.Background(), "Alloc")
+			assert.Equal(t, 3.0, v)
+			c, _ := mem.GetCounter(context.Background(), "PollCount")
+			assert.Equal(t, int64(5), c)
+			_, err = mem.GetGauge(context.Background(), "Heap")
+			assert.ErrorIs(t, err, repository.ErrNotFound)
+
+			w = post("/updates?partial=maybe")
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+}
+
+// Удаление и сброс: только с подписью, промах по серии — 404, изменения сразу попадают в снапшот
+func TestAdminDeleteReset(t *testing.T) {
+	const key = "secret"
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "metrics-db.json")
+	storage := repository.NewMemStorage()
+	storage.EnableHistory(10)
+	storage.UpdateGauge(ctx, "Alloc", 1)
+	storage.UpdateGauge(ctx, `Alloc{host="a"}`, 2)
+	storage.UpdateGauge(ctx, "HeapAlloc", 3)
+	storage.UpdateGauge(ctx, "cpu_user", 4)
+	storage.UpdateCounter(ctx, "cpuXuser", 5)
+	storage.UpdateCounter(ctx, "PollCount", 7)
+	storage.UpdateCounter(ctx, `PollCount{host="a"}`, 8)
+
+	r := chi.NewRouter()
+	r.Mount("/api/v1", apiV1Router(apiDeps{
+		reader: storage, writer: storage, key: key, hub: stream.NewHub(1),
+		persist: snapshotFunc(storage, file),
+	}))
+	post := func(url, body, sign string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		if sign != "" {
+			req.Header.Set("HashSHA256", cryptohelpers.Sign([]byte(body), sign))
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+	errCode := func(body string) string {
+		var er handler.ErrorResponse
+		require.NoError(t, json.Unmarshal([]byte(body), &er), body)
+		return er.Error.Code
+	}
+
+	status, body := post("/api/v1/admin/delete", `{"type":"gauge","id":"Alloc"}`, "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, handler.CodeUnauthorized, errCode(body))
+	status, body = post("/api/v1/admin/delete", `{"type":"gauge","id":"Alloc"}`, "wrong")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, handler.CodeInvalidSignature, errCode(body))
+
+	tests := []struct {
+		name, url, body string
+		status          int
+		want            string // тело ответа или код ошибки
+	}{
+		{"exact series", "/api/v1/admin/delete", `{"type":"gauge","id":"Alloc","labels":{"host":"a"}}`, 200, `{"deleted":1}`},
+		{"exact miss", "/api/v1/admin/delete", `{"type":"gauge","id":"Alloc","labels":{"host":"a"}}`, 404, handler.CodeNotFound},
+		{"wrong type", "/api/v1/admin/delete", `{"type":"counter","id":"Alloc"}`, 404, handler.CodeNotFound},
+		// _ в префиксе — обычный символ, а не шаблон LIKE
+		{"prefix literal", "/api/v1/admin/delete", `{"prefix":"cpu_"}`, 200, `{"deleted":1}`},
+		{"prefix any type", "/api/v1/admin/delete", `{"prefix":"Heap"}`, 200, `{"deleted":1}`},
+		{"prefix no match", "/api/v1/admin/delete", `{"prefix":"Nope"}`, 200, `{"deleted":0}`},
+		{"reset prefix", "/api/v1/admin/reset", `{"prefix":"Poll"}`, 200, `{"reset":2}`},
+		{"reset miss", "/api/v1/admin/reset", `{"id":"Alloc"}`, 404, handler.CodeNotFound},
+		{"no selector", "/api/v1/admin/delete", `{"type":"gauge"}`, 400, handler.CodeMissingID},
+		{"id and prefix", "/api/v1/admin/delete", `{"id":"A","prefix":"A"}`, 400, handler.CodeInvalidBody},
+		{"unknown type", "/api/v1/admin/delete", `{"type":"summary","id":"A"}`, 400, handler.CodeUnknownType},
+		{"unknown field", "/api/v1/admin/reset", `{"name":"A"}`, 400, handler.CodeInvalidJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := post(tt.url, tt.body, key)
+			assert.Equal(t, tt.status, status, body)
+			if status == http.StatusOK {
+				assert.JSONEq(t, tt.want, body)
+			} else {
+				assert.Equal(t, tt.want, errCode(body))
+			}
+		})
+	}
+
+	gauges, counters, err := storage.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"Alloc": 1}, gauges)
+	assert.Equal(t, map[string]int64{"cpuXuser": 5, "PollCount": 0, `PollCount{host="a"}`: 0}, counters)
+
+	// история удалённой серии удалена, сброс виден в истории нулём
+	now := time.Now()
+	samples, err := storage.QueryRange(ctx, models.Gauge, `Alloc{host="a"}`, now.Add(-time.Minute), now, 0)
+	require.NoError(t, err)
+	assert.Empty(t, samples)
+	samples, err = storage.QueryRange(ctx, models.Counter, "PollCount", now.Add(-time.Minute), now, 0)
+	require.NoError(t, err)
+	require.NotEmpty(t, samples)
+	assert.Equal(t, 0.0, samples[len(samples)-1].Value)
+
+	restored := repository.NewMemStorage()
+	require.NoError(t, restored.LoadFromFile(file))
+	gauges, counters, err = restored.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"Alloc": 1}, gauges)
+	assert.Equal(t, int64(0), counters["PollCount"])
+
+	// без ключа на сервере маршруты закрыты
+	r = chi.NewRouter()
+	r.Mount("/api/v1", apiV1Router(apiDeps{reader: storage, writer: storage, hub: stream.NewHub(1)}))
+	status, body = post("/api/v1/admin/reset", `{"prefix":"Poll"}`, key)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, handler.CodeForbidden, errCode(body))
+}
+
+// failingStorage — хранилище, все операции которого завершаются ошибкой err
+type failingStorage struct{ err error }
+
+func (f failingStorage) UpdateGauge(context.Context, string, float64) error { return f.err }
+func (f failingStorage) UpdateCounter(context.Context, string, int64) error { return f.err }
+func (f failingStorage) GetGauge(context.Context, string) (float64, error)  { return 0, f.err }
+func (f failingStorage) GetCounter(context.Context, string) (int64, error)  { return 0, f.err }
+func (f failingStorage) GetAllMetrics(context.Context) (map[string]float64, map[string]int64, error) {
+	return nil, nil, f.err
+}
+
+// Сбой хранилища не маскируется под 200 или 404: недоступность — 503 с Retry-After, прочее — 500
+func TestStorageErrors(t *testing.T) {
+	backends := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"unavailable", fmt.Errorf("get gauge: %w: dial tcp: connection refused", repository.ErrUnavailable), http.StatusServiceUnavailable, handler.CodeUnavailable},
+		{"internal", fmt.Errorf("scan gauge_metrics: bad value"), http.StatusInternalServerError, handler.CodeStorage},
+		{"timeout", fmt.Errorf("get gauge: %w: canceling statement due to statement timeout", repository.ErrTimeout), http.StatusGatewayTimeout, handler.CodeTimeout},
+	}
+	requests := []struct{ method, url, body string }{
+		{http.MethodPost, "/update/gauge/Alloc/1", ""},
+		{http.MethodPost, "/update/counter/PollCount/1", ""},
+		{http.MethodPost, "/update", `{"id":"Alloc","type":"gauge","value":1}`},
+		{http.MethodPost, "/updates", `[{"id":"Alloc","type":"gauge","value":1}]`},
+		{http.MethodPost, "/value", `{"id":"Alloc","type":"gauge"}`},
+		{http.MethodGet, "/value/counter/PollCount", ""},
+		{http.MethodGet, "/", ""},
+		{http.MethodGet, "/metrics", ""},
+	}
+	for _, b := range backends {
+		storage := failingStorage{err: b.err}
+		r := chi.NewRouter()
+		r.Post("/update/{type}/{name}/{value}", updateHandler(storage))
+		r.Post("/update", updateHandlerJSON(storage))
+		r.Post("/updates", handler.UpdatesHandler(storage, ""))
+		r.Post("/value", valueHandlerJSON(storage))
+		r.Get("/value/{type}/{name}", valueHandler(storage))
+		r.Get("/", dashboardHandler(storage, nil))
+		r.Get("/metrics", prometheusHandler(storage))
+
+		for _, req := range requests {
+			t.Run(b.name+" "+req.method+" "+req.url, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(req.method, req.url, strings.NewReader(req.body)))
+				require.Equal(t, b.status, w.Code)
+				var er handler.ErrorResponse
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&er))
+				assert.Equal(t, b.code, er.Error.Code)
+				if b.status == http.StatusServiceUnavailable {
+					assert.NotEmpty(t, w.Header().Get("Retry-After"))
+				} else {
+					assert.Empty(t, w.Header().Get("Retry-After"))
+				}
+			})
+		}
+	}
+}
+
+func intPtr(v int) *int { return &v }
+
+func TestPrometheusHandler(t *testing.T) {
+	storage := repository.NewMemStorage()
+	storage.UpdateGauge(context.Background(), "HeapAlloc", 1.5)
+	storage.UpdateGauge(context.Background(), "cpu.util-1", 42)
+	storage.UpdateCounter(context.Background(), "PollCount", 7)
+
+	r := chi.NewRouter()
+	r.Use(gzipResponseMiddleware)
+	r.Get("/metrics", prometheusHandler(storage))
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, prometheusContentType, resp.Header.Get("Content-Type"))
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	gr, err := gzip.NewReader(resp.Body)
+	assert.NoError(t, err)
+	defer gr.Close()
+	body, err := io.ReadAll(gr)
+	assert.NoError(t, err)
+
+	assert.Contains(t, string(body), "# TYPE HeapAlloc gauge\nHeapAlloc 1.5\n")
+	assert.Contains(t, string(body), "# TYPE cpu_util_1 gauge\ncpu_util_1 42\n")
+	assert.Contains(t, string(body), "# TYPE PollCount counter\nPollCount 7\n")
+}
+
+func TestSanitizeMetricName(t *testing.T) {
+	assert.Equal(t, "HeapAlloc", sanitizeMetricName("HeapAlloc"))
+	assert.Equal(t, "a_b_c", sanitizeMetricName("a.b-c"))
+	assert.Equal(t, "_1abc", sanitizeMetricName("1abc"))
+	assert.Equal(t, "_", sanitizeMetricName(""))
+}
+
+func TestQueryRangeHandler(t *testing.T) {
+	storage := repository.NewMemStorage()
+	storage.EnableHistory(2) // в буфере останутся только два последних значения
+	storage.UpdateGauge(context.Background(), "HeapAlloc", 1)
+	storage.UpdateGauge(context.Background(), "HeapAlloc", 2)
+	storage.UpdateGauge(context.Background(), "HeapAlloc", 3)
+	storage.UpdateCounter(context.Background(), "PollCount", 5)
+	storage.UpdateCounter(context.Background(), "PollCount", 5)
+
+	r := chi.NewRouter()
+	r.Get("/api/v1/query_range", handler.QueryRangeHandler(storage, ""))
+
+	tests := []struct {
+		name       string
+		url        string
+		wantStatus int
+		wantValues []float64
+	}{
+		{"gauge history", "/api/v1/query_range?id=HeapAlloc", http.StatusOK, []float64{2, 3}},
+		{"counter history", "/api/v1/query_range?id=PollCount&type=counter", http.StatusOK, []float64{5, 10}},
+		{"downsampled", "/api/v1/query_range?id=HeapAlloc&step=1h", http.StatusOK, []float64{3}},
+		{"unknown metric", "/api/v1/query_range?id=none", http.StatusOK, []float64{}},
+		{"missing id", "/api/v1/query_range", http.StatusBadRequest, nil},
+		{"bad step", "/api/v1/query_range?id=HeapAlloc&step=abc", http.StatusBadRequest, nil},
+		{"bad type", "/api/v1/query_range?id=HeapAlloc&type=other", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+			if res.StatusCode != http.StatusOK {
+				return
+			}
+			var resp handler.QueryRangeResponse
+			assert.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+			got := make([]float64, 0, len(resp.Values))
+			for _, s := range resp.Values {
+				got = append(got, s.Value)
+			}
+			assert.Equal(t, tt.wantValues, got)
+		})
+	}
+}
+
+func TestLabeledMetrics(t *testing.T) {
+	storage := repository.NewMemStorage()
+
+	r := chi.NewRouter()
+	r.Post("/update", updateHandlerJSON(storage))
+	r.Post("/value", valueHandlerJSON(storage))
+	r.Get("/value/{type}/{name}", valueHandler(storage))
+	r.Get("/metrics", prometheusHandler(storage))
+
+	post := func(path, body string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Result()
+	}
+	get := func(path string) (*http.Response, string) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		res := w.Result()
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		return res, string(body)
+	}
+
+	// одинаковый ID с разными метками — разные серии
+	for _, body := range []string{
+		`{"id":"HeapAlloc","type":"gauge","value":1,"labels":{"host":"a"}}`,
+		`{"id":"HeapAlloc","type":"gauge","value":2,"labels":{"host":"b"}}`,
+		`{"id":"HeapAlloc","type":"gauge","value":3}`,
+	} {
+		res := post("/update", body)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	res := post("/update", `{"id":"HeapAlloc","type":"gauge","value":1,"labels":{"bad-name":"a"}}`)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res = post("/value", `{"id":"HeapAlloc","type":"gauge","labels":{"host":"b"}}`)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, string(body), `"value":2`)
+	assert.Contains(t, string(body), `"labels":{"host":"b"}`)
+
+	res, text := get("/value/gauge/HeapAlloc?label=host=a")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "1", text)
+
+	res, text = get("/value/gauge/HeapAlloc")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "3", text)
+
+	res, _ = get("/value/gauge/HeapAlloc?label=host=c")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	_, text = get("/metrics")
+	assert.Equal(t, "# TYPE HeapAlloc gauge\nHeapAlloc 3\nHeapAlloc{host=\"a\"} 1\nHeapAlloc{host=\"b\"} 2\n", text)
+
+	_, text = get("/metrics?label=host=b")
+	assert.Equal(t, "# TYPE HeapAlloc gauge\nHeapAlloc{host=\"b\"} 2\n", text)
+}
+
+// При остановке сервер дожидается активных запросов и сохраняет финальный снимок в файл
+func TestGracefulShutdownFlushesSnapshot(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics-db.json")
+	storage := repository.NewMemStorage()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// PeriodicStore с большим интервалом так и не успеет сохранить снимок
+	go storage.PeriodicStore(ctx, file, time.Hour)
+
+	started := make(chan struct{})
+	r := chi.NewRouter()
+	r.Post("/update/{type}/{name}/{value}", updateHandler(storage))
+	r.Post("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		storage.UpdateCounter(r.Context(), "SlowCounter", 1)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: r}
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- serve(ctx, srv, ln, 5*time.Second) }()
+
+	baseURL := "http://" + ln.Addr().String()
+	resp, err := http.Post(baseURL+"/update/gauge/Alloc/42.5", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// запрос, который ещё выполняется в момент сигнала остановки
+	slowStatus := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(baseURL+"/slow", "text/plain", nil)
+		if err != nil {
+			slowStatus <- 0
+			return
+		}
+		resp.Body.Close()
+		slowStatus <- resp.StatusCode
+	}()
+	<-started
+	cancel()
+
+	require.NoError(t, <-serveErr)
+	assert.Equal(t, http.StatusOK, <-slowStatus)
+
+	require.NoError(t, flushOnShutdown(storage, file, nil))
+
+	restored := repository.NewMemStorage()
+	require.NoError(t, restored.LoadFromFile(file))
+	v, err := restored.GetGauge(context.Background(), "Alloc")
+	assert.NoError(t, err)
+	assert.Equal(t, 42.5, v)
+	c, err := restored.GetCounter(context.Background(), "SlowCounter")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), c)
+}
+
+// Telegraf шлёт line protocol в gzip: поля становятся gauge или counter по суффиксу, теги — метками
+func TestInfluxWriteHandler(t *testing.T) {
+	storage := repository.NewMemStorage()
+	r := chi.NewRouter()
+	r.Use(gzipRequestMiddleware)
+	r.Post("/api/v2/write", handler.InfluxWriteHandler(storage, []string{"_total"}))
+
+	body := strings.Join([]string{
+		`cpu,host=web1,cpu=cpu0 usage_idle=97.5,usage_user=1.25 1700000000000000000`,
+		`http,host=web1 requests_total=10i,path="/a b,c"`,
+		`http,host=web1 requests_total=15i`,
+		`disk\ io,host=web1 busy=t`,
+		`# комментарий`,
+		``,
+	}, "\n")
+	var buf strings.Builder
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write([]byte(body))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v2/write", strings.NewReader(buf.String()))
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	ctx := context.Background()
+	idle, err := storage.GetGauge(ctx, `cpu_usage_idle{cpu="cpu0",host="web1"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 97.5, idle)
+	user, _ := storage.GetGauge(ctx, `cpu_usage_user{cpu="cpu0",host="web1"}`)
+	assert.Equal(t, 1.25, user)
+	// requests_total накопительный: первое значение только запоминается, дальше пишется прирост
+	requests, err := storage.GetCounter(ctx, `http_requests_total{host="web1"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), requests)
+	req = httptest.NewRequest(http.MethodPost, "/api/v2/write", strings.NewReader(`http,host=web1 requests_total=22i`))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	requests, _ = storage.GetCounter(ctx, `http_requests_total{host="web1"}`)
+	assert.Equal(t, int64(12), requests)
+	busy, _ := storage.GetGauge(ctx, `disk io_busy{host="web1"}`)
+	assert.Equal(t, 1.0, busy)
+
+	// ошибка в любой строке — 400, ничего не записано
+	for _, bad := range []string{
+		"cpu usage_idle=abc",
+		"cpu",
+		"cpu,host usage=1",
+		"cpu usage=1 notatime",
+		"ok value=1\nbroken value=",
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v2/write", strings.NewReader(bad))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, bad)
+	}
+	_, err = storage.GetGauge(ctx, "ok_value")
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+}
+
+// Подписчик /api/v1/stream получает принятые обновления, отфильтрованные по шаблону ID
+func TestStreamHandler(t *testing.T) {
+	hub := stream.NewHub(16)
+	writer := stream.NewPublishingStorage(repository.NewMemStorage(), hub)
+
+	r := chi.NewRouter()
+	r.Use(gzipResponseMiddleware)
+	r.Post("/update/{type}/{name}/{value}", updateHandler(writer))
+	r.Post("/updates", handler.UpdatesHandler(writer, ""))
+	r.Get("/api/v1/stream", handler.StreamHandler(hub))
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	defer hub.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/stream?id=Poll*&type=counter", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip") // поток должен сбрасываться и через gzip
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	body, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+
+	require.Eventually(t, hub.Active, time.Second, 10*time.Millisecond)
+	for _, u := range []string{"/update/gauge/Alloc/1", "/update/counter/PollCount/2"} {
+		res, err := http.Post(ts.URL+u, "text/plain", nil)
+		require.NoError(t, err)
+		res.Body.Close()
+	}
+	res, err := http.Post(ts.URL+"/updates", "application/json",
+		strings.NewReader(`[{"id":"PollCount","type":"counter","delta":3},{"id":"HeapAlloc","type":"gauge","value":5}]`))
+	require.NoError(t, err)
+	res.Body.Close()
+
+	sc := bufio.NewScanner(body)
+	var events []stream.Event
+	for len(events) < 2 && sc.Scan() {
+		data, ok := strings.CutPrefix(sc.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var e stream.Event
+		require.NoError(t, json.Unmarshal([]byte(data), &e))
+		events = append(events, e)
+	}
+	require.Len(t, events, 2)
+	assert.Equal(t, "PollCount", events[0].ID)
+	assert.Equal(t, int64(2), *events[0].Delta)
+	assert.Equal(t, int64(2), *events[0].Total)
+	assert.Equal(t, int64(3), *events[1].Delta)
+	assert.Equal(t, int64(5), *events[1].Total)
+}
+
+func TestParseMigrateArgs(t *testing.T) {
+	t.Setenv("DATABASE_DSN", "")
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    migrateCmd
+		wantErr bool
+	}{
+		{name: "status", args: []string{"-d", "dsn", "status"}, want: migrateCmd{dsn: "dsn", action: "status"}},
+		{name: "up", args: []string{"-d", "dsn", "up"}, want: migrateCmd{dsn: "dsn", action: "up"}},
+		{name: "down", args: []string{"-d", "dsn", "down", "2"}, want: migrateCmd{dsn: "dsn", action: "down", n: 2}},
+		{name: "force", args: []string{"-d", "dsn", "force", "3"}, want: migrateCmd{dsn: "dsn", action: "force", n: 3}},
+		{name: "force nil version", args: []string{"-d", "dsn", "force", "-1"}, want: migrateCmd{dsn: "dsn", action: "force", n: -1}},
+		{name: "no dsn", args: []string{"up"}, wantErr: true},
+		{name: "no command", args: []string{"-d", "dsn"}, wantErr: true},
+		{name: "unknown command", args: []string{"-d", "dsn", "drop"}, wantErr: true},
+		{name: "down without n", args: []string{"-d", "dsn", "down"}, wantErr: true},
+		{name: "down zero", args: []string{"-d", "dsn", "down", "0"}, wantErr: true},
+		{name: "force not a number", args: []string{"-d", "dsn", "force", "x"}, wantErr: true},
+		{name: "extra args", args: []string{"-d", "dsn", "up", "1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMigrateArgs(tt.args)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("env overrides flag", func(t *testing.T) {
+		t.Setenv("DATABASE_DSN", "env-dsn")
+		got, err := parseMigrateArgs([]string{"-d", "dsn", "status"})
+		require.NoError(t, err)
+		assert.Equal(t, "env-dsn", got.dsn)
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// serve обслуживает запросы на ln, пока не отменён ctx, после чего корректно останавливает сервер:
+// новые соединения не принимаются, активные запросы дорабатывают в пределах timeout.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, timeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errCh:
+		// сервер упал сам, без сигнала остановки
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Log.Info("Shutting down server", zap.Duration("timeout", timeout))
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		// не уложились в таймаут — рвём оставшиеся соединения
+		_ = srv.Close()
+		return fmt.Errorf("server shutdown: %w", err)
+	}
+	if err := <-errCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// flushOnShutdown сохраняет финальный снимок in-memory хранилища и закрывает пул соединений с БД.
+// Вызывается после остановки HTTP-сервера и PeriodicStore, когда новых обновлений и других записей файла уже не будет.
+func flushOnShutdown(storage repository.Storage, filename string, db *pgxpool.Pool) error {
+	var errs []error
+
+	if memStorage, ok := storage.(*repository.MemStorage); ok && filename != "" {
+		if err := memStorage.SaveToFile(filename); err != nil {
+			errs = append(errs, fmt.Errorf("final snapshot: %w", err))
+		} else {
+			logger.Log.Info("Final snapshot saved", zap.String("file", filename))
+		}
+	}
+
+	if db != nil {
+		db.Close()
+	}
+
+	return errors.Join(errs...)
+}
+
+// serveGRPC обслуживает gRPC на ln, пока не отменён ctx, после чего дожидается активных вызовов
+// в пределах timeout и обрывает оставшиеся.
+func serveGRPC(ctx context.Context, srv *grpc.Server, ln net.Listener, timeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		srv.Stop()
+		<-stopped
+		return fmt.Errorf("grpc shutdown: timeout exceeded")
+	}
+	if err := <-errCh; err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRules = `{
+  "evaluation_interval": "10s",
+  "webhooks": ["http://localhost:9093/hook"],
+  "rules": [
+    {"name": "LowMemory", "metric": "FreeMemory", "type": "gauge", "condition": "< 1024", "for": "1m",
+     "labels": {"severity": "page"}},
+    {"name": "AgentStalled", "metric": "PollCount", "type": "counter", "condition": "absent", "for": "30s"},
+    {"name": "HostDown", "metric": "Load1", "match": {"host": "a"}, "condition": "absent"}
+  ]
+}`
+
+func writeRules(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "alerts.json")
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig(writeRules(t, testRules))
+	require.NoError(t, err)
+	assert.Equal(t, Duration(10*time.Second), cfg.Interval)
+	require.Len(t, cfg.Rules, 3)
+	assert.Equal(t, "<", cfg.Rules[0].op)
+	assert.Equal(t, 1024.0, cfg.Rules[0].threshold)
+	assert.Equal(t, Duration(time.Minute), cfg.Rules[0].For)
+	assert.Equal(t, condAbsent, cfg.Rules[1].op)
+	assert.Equal(t, `Load1{host="a"}`, cfg.Rules[2].Series())
+
+	for name, data := range map[string]string{
+		"bad condition":  `{"rules": [{"name": "r", "metric": "m", "condition": "~ 1"}]}`,
+		"bad threshold":  `{"rules": [{"name": "r", "metric": "m", "condition": ">= abc"}]}`,
+		"no metric":      `{"rules": [{"name": "r", "condition": "absent"}]}`,
+		"duplicate name": `{"rules": [{"name": "r", "metric": "a", "condition": "absent"}, {"name": "r", "metric": "b", "condition": "absent"}]}`,
+		"bad type":       `{"rules": [{"name": "r", "metric": "m", "type": "histogram", "condition": "> 1"}]}`,
+		"bad for":        `{"rules": [{"name": "r", "metric": "m", "condition": "> 1", "for": "soon"}]}`,
+		"bad webhook":    `{"webhooks": ["ftp://x"], "rules": []}`,
+		"unknown field":  `{"rulez": []}`,
+	} {
+		_, err := LoadConfig(writeRules(t, data))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestEngineThresholdRule(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := LoadConfig(writeRules(t, testRules))
+	require.NoError(t, err)
+	storage := repository.NewMemStorage()
+	e := NewEngine(storage, cfg.Rules[:1])
+
+	start := time.Now()
+	storage.UpdateGauge(ctx, "FreeMemory", 4096)
+	assert.Empty(t, e.Evaluate(ctx, start))
+	assert.Equal(t, StateInactive, e.Alerts()[0].State)
+
+	// условие выполняется, но меньше for — только pending
+	storage.UpdateGauge(ctx, "FreeMemory", 512)
+	assert.Empty(t, e.Evaluate(ctx, start.Add(10*time.Second)))
+	assert.Equal(t, StatePending, e.Alerts()[0].State)
+
+	got := e.Evaluate(ctx, start.Add(70*time.Second))
+	require.Len(t, got, 1)
+	assert.Equal(t, StateFiring, got[0].Status)
+	assert.Equal(t, "FreeMemory", got[0].Series)
+	assert.Equal(t, 512.0, *got[0].Value)
+	assert.Equal(t, start.Add(10*time.Second), got[0].StartsAt)
+	assert.Equal(t, map[string]string{"severity": "page"}, got[0].Labels)
+
+	// повторно firing не отправляется
+	assert.Empty(t, e.Evaluate(ctx, start.Add(80*time.Second)))
+
+	storage.UpdateGauge(ctx, "FreeMemory", 8192)
+	got = e.Evaluate(ctx, start.Add(90*time.Second))
+	require.Len(t, got, 1)
+	assert.Equal(t, StateResolved, got[0].Status)
+	require.NotNil(t, got[0].EndsAt)
+	assert.Equal(t, StateInactive, e.Alerts()[0].State)
+
+	// pending, который не дожил до for, снимается без уведомлений
+	storage.UpdateGauge(ctx, "FreeMemory", 100)
+	assert.Empty(t, e.Evaluate(ctx, start.Add(100*time.Second)))
+	storage.UpdateGauge(ctx, "FreeMemory", 8192)
+	assert.Empty(t, e.Evaluate(ctx, start.Add(110*time.Second)))
+	assert.Equal(t, StateInactive, e.Alerts()[0].State)
+}
+
+func TestEngineAbsentRules(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := LoadConfig(writeRules(t, testRules))
+	require.NoError(t, err)
+	storage := repository.NewMemStorage()
+	e := NewEngine(storage, cfg.Rules[1:])
+
+	start := time.Now()
+	storage.UpdateCounter(ctx, "PollCount", 5)
+	storage.UpdateGauge(ctx, models.SeriesID("Load1", models.Labels{"host": "a"}), 0.5)
+	assert.Empty(t, e.Evaluate(ctx, start))
+
+	// gauge с прежним значением — норма, а counter, который не растёт, — пропал
+	assert.Empty(t, e.Evaluate(ctx, start.Add(10*time.Second)))
+	alerts := e.Alerts()
+	assert.Equal(t, StatePending, alerts[0].State)
+	assert.Equal(t, StateInactive, alerts[1].State)
+
+	got := e.Evaluate(ctx, start.Add(40*time.Second))
+	require.Len(t, got, 1)
+	assert.Equal(t, "AgentStalled", got[0].Rule)
+	assert.Equal(t, StateFiring, got[0].Status)
+
+	storage.UpdateCounter(ctx, "PollCount", 1)
+	got = e.Evaluate(ctx, start.Add(50*time.Second))
+	require.Len(t, got, 1)
+	assert.Equal(t, StateResolved, got[0].Status)
+
+	// серии нет в хранилище — без for алерт срабатывает сразу
+	e = NewEngine(repository.NewMemStorage(), cfg.Rules[2:])
+	got = e.Evaluate(ctx, start)
+	require.Len(t, got, 1)
+	assert.Equal(t, "HostDown", got[0].Rule)
+	assert.Nil(t, got[0].Value)
+}
+
+func TestNotifierRetries(t *testing.T) {
+	var calls atomic.Int32
+	var received Notification
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// первая попытка падает — доставка должна пройти со второй
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer srv.Close()
+
+	var rejected atomic.Int32
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rejected.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+
+	n := NewNotifier([]string{srv.URL})
+	n.delays = []time.Duration{time.Millisecond, time.Millisecond}
+
+	v := 1.5
+	nt := Notification{Status: StateFiring, Rule: "LowMemory", Series: "FreeMemory", Value: &v, StartsAt: time.Now()}
+	require.NoError(t, n.Send(context.Background(), nt))
+	assert.Equal(t, int32(2), calls.Load())
+	assert.Equal(t, "LowMemory", received.Rule)
+	assert.Equal(t, StateFiring, received.Status)
+
+	// 4xx не повторяется
+	n.urls = []string{rejecting.URL}
+	assert.Error(t, n.Send(context.Background(), nt))
+	assert.Equal(t, int32(1), rejected.Load())
+}
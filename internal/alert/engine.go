@@ -0,0 +1,227 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"go.uber.org/zap"
+)
+
+// State — состояние правила. Resolved бывает только в уведомлениях: после него правило снова inactive.
+type State string
+
+const (
+	StateInactive State = "inactive"
+	StatePending  State = "pending"
+	StateFiring   State = "firing"
+	StateResolved State = "resolved"
+)
+
+// Notification — тело запроса к webhook'у при срабатывании и снятии алерта
+type Notification struct {
+	Status    State             `json:"status"`
+	Rule      string            `json:"rule"`
+	Series    string            `json:"series"`
+	Condition string            `json:"condition"`
+	Value     *float64          `json:"value,omitempty"` // nil — метрики нет в хранилище
+	Labels    map[string]string `json:"labels,omitempty"`
+	StartsAt  time.Time         `json:"starts_at"`
+	EndsAt    *time.Time        `json:"ends_at,omitempty"`
+}
+
+// Alert — текущее состояние правила (для GET /api/v1/alerts)
+type Alert struct {
+	Rule        string            `json:"rule"`
+	Series      string            `json:"series"`
+	State       State             `json:"state"`
+	Value       *float64          `json:"value,omitempty"`
+	ActiveSince *time.Time        `json:"active_since,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// ruleState — то, что движок помнит о правиле между вычислениями
+type ruleState struct {
+	state       State
+	activeSince time.Time
+	value       float64
+	present     bool
+}
+
+// Engine вычисляет правила по хранилищу и отслеживает переходы inactive → pending → firing → resolved
+type Engine struct {
+	storage repository.Storage
+	rules   []Rule
+
+	mu     sync.Mutex
+	states []ruleState
+}
+
+// NewEngine создаёт движок; правила должны быть проверены LoadConfig
+func NewEngine(storage repository.Storage, rules []Rule) *Engine {
+	states := make([]ruleState, len(rules))
+	for i := range states {
+		states[i].state = StateInactive
+	}
+	return &Engine{storage: storage, rules: rules, states: states}
+}
+
+// Evaluate вычисляет все правила на момент now и возвращает уведомления о сменах состояния
+func (e *Engine) Evaluate(ctx context.Context, now time.Time) []Notification {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var out []Notification
+	for i := range e.rules {
+		r := &e.rules[i]
+		st := &e.states[i]
+
+		value, mtype, present, err := e.lookup(ctx, r)
+		if err != nil {
+			// хранилище недоступно — состояние правила не меняем, иначе absent сработал бы ложно
+			logger.Log.Warn("alert rule skipped", zap.String("rule", r.Name), zap.Error(err))
+			continue
+		}
+		active := r.active(st, value, mtype, present)
+		st.value, st.present = value, present
+
+		switch {
+		case active && st.state == StateInactive:
+			st.state, st.activeSince = StatePending, now
+			if r.For > 0 {
+				continue
+			}
+			fallthrough
+		case active && st.state == StatePending:
+			if now.Sub(st.activeSince) >= time.Duration(r.For) {
+				st.state = StateFiring
+				out = append(out, r.notification(StateFiring, st, nil))
+			}
+		case !active && st.state == StateFiring:
+			end := now
+			out = append(out, r.notification(StateResolved, st, &end))
+			st.state = StateInactive
+		case !active:
+			st.state = StateInactive
+		}
+	}
+	return out
+}
+
+// Alerts возвращает текущее состояние всех правил в порядке файла
+func (e *Engine) Alerts() []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	out := make([]Alert, len(e.rules))
+	for i := range e.rules {
+		r, st := &e.rules[i], &e.states[i]
+		a := Alert{Rule: r.Name, Series: r.Series(), State: st.state, Labels: r.Labels}
+		if st.present {
+			v := st.value
+			a.Value = &v
+		}
+		if st.state != StateInactive {
+			since := st.activeSince
+			a.ActiveSince = &since
+		}
+		out[i] = a
+	}
+	return out
+}
+
+// Run вычисляет правила раз в every до отмены ctx. Уведомления уходят по порядку из отдельной горутины,
+// чтобы ретраи webhook'ов не задерживали вычисление.
+func (e *Engine) Run(ctx context.Context, every time.Duration, n *Notifier) {
+	queue := make(chan Notification, 64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for nt := range queue {
+			if err := n.Send(ctx, nt); err != nil {
+				logger.Log.Error("alert notification failed",
+					zap.String("rule", nt.Rule), zap.String("status", string(nt.Status)), zap.Error(err))
+			}
+		}
+	}()
+	defer func() {
+		close(queue)
+		<-done
+	}()
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, nt := range e.Evaluate(ctx, now) {
+				logger.Log.Info("alert state changed",
+					zap.String("rule", nt.Rule), zap.String("status", string(nt.Status)))
+				select {
+				case queue <- nt:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
+
+// lookup читает значение серии правила и тип, под которым она нашлась; counter приводится к float64.
+// Отсутствие серии — present == false, ошибка возвращается только при сбое хранилища.
+func (e *Engine) lookup(ctx context.Context, r *Rule) (float64, string, bool, error) {
+	key := r.Series()
+	if r.Type != models.Counter {
+		v, err := e.storage.GetGauge(ctx, key)
+		if err == nil {
+			return v, models.Gauge, true, nil
+		}
+		if !errors.Is(err, repository.ErrNotFound) {
+			return 0, "", false, err
+		}
+		if r.Type == models.Gauge {
+			return 0, "", false, nil
+		}
+	}
+	v, err := e.storage.GetCounter(ctx, key)
+	if errors.Is(err, repository.ErrNotFound) {
+		return 0, "", false, nil
+	}
+	return float64(v), models.Counter, err == nil, err
+}
+
+// active сообщает, выполняется ли условие правила. Для absent значение gauge не проверяется:
+// постоянное значение — нормальное состояние gauge, а counter, который не растёт, считается пропавшим.
+func (r *Rule) active(st *ruleState, value float64, mtype string, present bool) bool {
+	if r.op == condAbsent {
+		if !present {
+			return true
+		}
+		return mtype == models.Counter && st.present && value == st.value
+	}
+	return present && compare(r.op, value, r.threshold)
+}
+
+func (r *Rule) notification(status State, st *ruleState, end *time.Time) Notification {
+	n := Notification{
+		Status:    status,
+		Rule:      r.Name,
+		Series:    r.Series(),
+		Condition: r.Condition,
+		Labels:    r.Labels,
+		StartsAt:  st.activeSince,
+		EndsAt:    end,
+	}
+	if st.present {
+		v := st.value
+		n.Value = &v
+	}
+	return n
+}
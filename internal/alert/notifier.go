@@ -0,0 +1,92 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/retry"
+)
+
+// webhookDelays — задержки между повторными попытками доставки уведомления
+var webhookDelays = []time.Duration{time.Second, 3 * time.Second, 5 * time.Second}
+
+// webhookTimeout — таймаут одной попытки доставки
+const webhookTimeout = 10 * time.Second
+
+// Notifier отправляет уведомления POST-запросом с JSON на все webhook'и из конфигурации
+type Notifier struct {
+	client *http.Client
+	urls   []string
+	delays []time.Duration
+}
+
+func NewNotifier(urls []string) *Notifier {
+	return &Notifier{
+		client: &http.Client{Timeout: webhookTimeout},
+		urls:   urls,
+		delays: webhookDelays,
+	}
+}
+
+// webhookError — ответ webhook'а с ошибкой; повторяем только 5xx и 429
+type webhookError struct {
+	status int
+}
+
+func (e *webhookError) Error() string {
+	return fmt.Sprintf("webhook responded %d", e.status)
+}
+
+// Send доставляет уведомление на каждый webhook с ретраями; ошибки по адресам объединяются
+func (n *Notifier) Send(ctx context.Context, nt Notification) error {
+	body, err := json.Marshal(nt)
+	if err != nil {
+		return fmt.Errorf("marshal notification: %w", err)
+	}
+
+	var errs []error
+	for _, url := range n.urls {
+		err := retry.DoIf(ctx, n.delays, func(ctx context.Context) error {
+			return n.post(ctx, url, body)
+		}, retriable)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", url, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (n *Notifier) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &webhookError{status: resp.StatusCode}
+	}
+	return nil
+}
+
+// retriable: сетевые ошибки, 5xx и 429 — повторяем; прочие 4xx — ошибка в запросе, повтор не поможет
+func retriable(err error) bool {
+	var we *webhookError
+	if errors.As(err, &we) {
+		return we.status >= 500 || we.status == http.StatusTooManyRequests
+	}
+	return !errors.Is(err, context.Canceled)
+}
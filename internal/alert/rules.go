@@ -0,0 +1,172 @@
+// Package alert вычисляет правила алертов по метрикам хранилища и отправляет уведомления в webhook'и.
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+)
+
+// defaultInterval — период вычисления правил, если в файле он не задан
+const defaultInterval = 15 * time.Second
+
+// condAbsent — условие отсутствия: метрики нет в хранилище, а counter к тому же перестал расти
+const condAbsent = "absent"
+
+// Config — файл правил (JSON)
+type Config struct {
+	Interval Duration `json:"evaluation_interval"`
+	Webhooks []string `json:"webhooks"`
+	Rules    []Rule   `json:"rules"`
+}
+
+// Rule — правило алерта. Condition — сравнение вида "< 1048576" (<, <=, >, >=, ==, !=) или "absent".
+// Алерт срабатывает, если условие выполняется не меньше For подряд.
+type Rule struct {
+	Name      string            `json:"name"`
+	Metric    string            `json:"metric"`
+	Type      string            `json:"type,omitempty"`  // gauge или counter; пусто — сначала gauge, затем counter
+	Match     models.Labels     `json:"match,omitempty"` // метки серии, пусто — серия без меток
+	Condition string            `json:"condition"`
+	For       Duration          `json:"for,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"` // метки уведомления, напр. severity
+
+	op        string
+	threshold float64
+}
+
+// Series возвращает ключ серии, которую проверяет правило
+func (r *Rule) Series() string {
+	return models.SeriesID(r.Metric, r.Match)
+}
+
+// Duration — time.Duration, который в JSON записывается строкой ("30s", "5m")
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// LoadConfig читает и проверяет файл правил
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read alert rules: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parse alert rules %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("alert rules %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+func (c *Config) validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("evaluation_interval must be positive")
+	}
+	if c.Interval == 0 {
+		c.Interval = Duration(defaultInterval)
+	}
+	for _, raw := range c.Webhooks {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook url %q", raw)
+		}
+	}
+
+	names := make(map[string]bool, len(c.Rules))
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if r.Name == "" {
+			return fmt.Errorf("rule #%d: name is required", i+1)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("rule %q: duplicate name", r.Name)
+		}
+		names[r.Name] = true
+		if r.Metric == "" {
+			return fmt.Errorf("rule %q: metric is required", r.Name)
+		}
+		if err := models.ValidateID(r.Metric); err != nil {
+			return fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		if r.Type != "" && r.Type != models.Gauge && r.Type != models.Counter {
+			return fmt.Errorf("rule %q: unknown metric type %q", r.Name, r.Type)
+		}
+		if err := models.ValidateLabels(r.Match); err != nil {
+			return fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		if r.For < 0 {
+			return fmt.Errorf("rule %q: negative for", r.Name)
+		}
+		op, threshold, err := parseCondition(r.Condition)
+		if err != nil {
+			return fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		r.op, r.threshold = op, threshold
+	}
+	return nil
+}
+
+// operators упорядочены так, чтобы "<=" проверялся раньше "<"
+var operators = []string{"<=", ">=", "==", "!=", "<", ">"}
+
+// parseCondition разбирает условие правила: "absent" или оператор сравнения и порог
+func parseCondition(s string) (string, float64, error) {
+	s = strings.TrimSpace(s)
+	if s == condAbsent {
+		return condAbsent, 0, nil
+	}
+	for _, op := range operators {
+		rest, ok := strings.CutPrefix(s, op)
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(rest), 64)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid threshold in condition %q", s)
+		}
+		return op, v, nil
+	}
+	return "", 0, fmt.Errorf("invalid condition %q: expected comparison like \"< 100\" or \"absent\"", s)
+}
+
+// compare применяет оператор правила к значению
+func compare(op string, v, threshold float64) bool {
+	switch op {
+	case "<":
+		return v < threshold
+	case "<=":
+		return v <= threshold
+	case ">":
+		return v > threshold
+	case ">=":
+		return v >= threshold
+	case "==":
+		return v == threshold
+	case "!=":
+		return v != threshold
+	}
+	return false
+}
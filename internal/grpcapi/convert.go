@@ -0,0 +1,44 @@
+package grpcapi
+
+import (
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/metricspb"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+)
+
+// ToProto переводит метрику из JSON-модели в protobuf
+func ToProto(m models.Metrics) *metricspb.Metric {
+	pm := &metricspb.Metric{Id: m.ID, Labels: m.Labels}
+	switch m.MType {
+	case models.Counter:
+		pm.Type = metricspb.Metric_COUNTER
+		if m.Delta != nil {
+			pm.Delta = *m.Delta
+		}
+	default:
+		pm.Type = metricspb.Metric_GAUGE
+		if m.Value != nil {
+			pm.Value = *m.Value
+		}
+	}
+	return pm
+}
+
+// FromProto переводит метрику из protobuf в JSON-модель
+func FromProto(pm *metricspb.Metric) models.Metrics {
+	m := models.Metrics{ID: pm.GetId(), Labels: models.Labels(pm.GetLabels())}
+	if len(m.Labels) == 0 {
+		m.Labels = nil
+	}
+	switch pm.GetType() {
+	case metricspb.Metric_COUNTER:
+		d := pm.GetDelta()
+		m.MType, m.Delta = models.Counter, &d
+	case metricspb.Metric_GAUGE:
+		v := pm.GetValue()
+		m.MType, m.Value = models.Gauge, &v
+	default:
+		// неизвестный тип отклоняет handler.ValidateMetric
+		m.MType = pm.GetType().String()
+	}
+	return m
+}
@@ -0,0 +1,149 @@
+package grpcapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/cryptohelpers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// HashMetadataKey — ключ metadata с подписью HMAC-SHA256, аналог заголовка HashSHA256 в HTTP API
+const HashMetadataKey = "hashsha256"
+
+// подписываются детерминированно сериализованные сообщения: порядок ключей map фиксирован
+var signMarshal = proto.MarshalOptions{Deterministic: true}
+
+// signMessages возвращает подпись последовательности сообщений
+func signMessages(key string, msgs ...proto.Message) (string, error) {
+	var buf bytes.Buffer
+	for _, m := range msgs {
+		b, err := signMarshal.Marshal(m)
+		if err != nil {
+			return "", err
+		}
+		buf.Write(b)
+	}
+	return cryptohelpers.Sign(buf.Bytes(), key), nil
+}
+
+// SignContext добавляет в исходящую metadata подпись сообщений.
+// Для client-streaming вызова подписываются все сообщения потока по порядку — до его открытия.
+func SignContext(ctx context.Context, key string, msgs ...proto.Message) (context.Context, error) {
+	if key == "" {
+		return ctx, nil
+	}
+	hash, err := signMessages(key, msgs...)
+	if err != nil {
+		return ctx, err
+	}
+	return metadata.AppendToOutgoingContext(ctx, HashMetadataKey, hash), nil
+}
+
+// UnaryClientHMAC подписывает запросы unary-вызовов
+func UnaryClientHMAC(key string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if msg, ok := req.(proto.Message); ok && key != "" {
+			signed, err := SignContext(ctx, key, msg)
+			if err != nil {
+				return err
+			}
+			ctx = signed
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// incomingHash возвращает подпись из metadata запроса; пустая строка — запрос не подписан
+func incomingHash(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if vals := md.Get(HashMetadataKey); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+var errInvalidSignature = status.Error(codes.InvalidArgument, "invalid signature")
+
+// UnaryServerHMAC проверяет подпись запроса и подписывает ответ — как ValidateHashSHA256 и
+// WriteSignedJSONResponse в HTTP API. Запросы без подписи пропускаются для обратной совместимости.
+func UnaryServerHMAC(key string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if key == "" {
+			return handler(ctx, req)
+		}
+		if sent := incomingHash(ctx); sent != "" {
+			msg, ok := req.(proto.Message)
+			if !ok {
+				return nil, errInvalidSignature
+			}
+			b, err := signMarshal.Marshal(msg)
+			if err != nil || !cryptohelpers.Compare(b, key, sent) {
+				return nil, errInvalidSignature
+			}
+		}
+
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return resp, err
+		}
+		if msg, ok := resp.(proto.Message); ok {
+			if hash, err := signMessages(key, msg); err == nil {
+				_ = grpc.SetHeader(ctx, metadata.Pairs(HashMetadataKey, hash))
+			}
+		}
+		return resp, nil
+	}
+}
+
+// StreamServerHMAC проверяет подпись client-streaming вызова: подпись покрывает все сообщения потока,
+// поэтому сверяется по его окончании — вместо io.EOF обработчик получит ошибку и ничего не применит.
+func StreamServerHMAC(key string) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if key == "" {
+			return handler(srv, ss)
+		}
+		sent := incomingHash(ss.Context())
+		if sent == "" {
+			return handler(srv, ss)
+		}
+		return handler(srv, &signedStream{ServerStream: ss, key: key, sent: sent})
+	}
+}
+
+// signedStream копит принятые сообщения для проверки подписи
+type signedStream struct {
+	grpc.ServerStream
+	key  string
+	sent string
+	buf  bytes.Buffer
+}
+
+func (s *signedStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if errors.Is(err, io.EOF) {
+		if !cryptohelpers.Compare(s.buf.Bytes(), s.key, s.sent) {
+			return errInvalidSignature
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return errInvalidSignature
+	}
+	b, err := signMarshal.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	s.buf.Write(b)
+	return nil
+}
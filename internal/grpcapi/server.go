@@ -0,0 +1,180 @@
+// Package grpcapi — gRPC-сервис метрик поверх repository.Storage (см. proto/metrics.proto).
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/handler"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/metricspb"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxBatchMetrics ограничивает размер пакета UpdateBatch, как лимит тела в /updates
+const maxBatchMetrics = 100_000
+
+// Server реализует metricspb.MetricsServer
+type Server struct {
+	metricspb.UnimplementedMetricsServer
+	storage repository.Storage
+}
+
+func NewServer(storage repository.Storage) *Server {
+	return &Server{storage: storage}
+}
+
+// NewGRPCServer создаёт gRPC-сервер с сервисом Metrics; при непустом key запросы проверяются по HMAC
+func NewGRPCServer(storage repository.Storage, key string) *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(UnaryServerHMAC(key)),
+		grpc.ChainStreamInterceptor(StreamServerHMAC(key)),
+	)
+	metricspb.RegisterMetricsServer(srv, NewServer(storage))
+	return srv
+}
+
+// invalid переводит ошибку проверки из handler в статус InvalidArgument
+func invalid(e *handler.Error) error {
+	return status.Error(codes.InvalidArgument, e.Code+": "+e.Message)
+}
+
+// Update обновляет одну метрику и возвращает её значение после обновления
+func (s *Server) Update(ctx context.Context, req *metricspb.UpdateRequest) (*metricspb.UpdateResponse, error) {
+	if req.GetMetric() == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing metric")
+	}
+	m := FromProto(req.GetMetric())
+	if e := handler.ValidateMetric(m); e != nil {
+		return nil, invalid(e)
+	}
+	key := m.SeriesID()
+
+	switch m.MType {
+	case models.Counter:
+		if err := s.storage.UpdateCounter(ctx, key, *m.Delta); err != nil {
+			return nil, storageError(err)
+		}
+		if v, err := s.storage.GetCounter(ctx, key); err == nil {
+			m.Delta = &v
+		}
+	default:
+		if err := s.storage.UpdateGauge(ctx, key, *m.Value); err != nil {
+			return nil, storageError(err)
+		}
+	}
+	return &metricspb.UpdateResponse{Metric: ToProto(m)}, nil
+}
+
+// UpdateBatch принимает пакет частями и применяет его целиком после закрытия потока клиентом
+func (s *Server) UpdateBatch(stream grpc.ClientStreamingServer[metricspb.UpdateBatchRequest, metricspb.UpdateBatchResponse]) error {
+	var batch []models.Metrics
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(batch)+len(req.GetMetrics()) > maxBatchMetrics {
+			return status.Error(codes.ResourceExhausted, "batch is too large")
+		}
+		for _, pm := range req.GetMetrics() {
+			if pm == nil {
+				return status.Error(codes.InvalidArgument, "missing metric")
+			}
+			batch = append(batch, FromProto(pm))
+		}
+	}
+	if len(batch) == 0 {
+		return status.Error(codes.InvalidArgument, "empty batch")
+	}
+
+	// пакет применяется целиком, как /updates без ?partial
+	report, valid := handler.ValidateBatch(batch)
+	if first, ok := report.FirstRejected(); ok {
+		return status.Errorf(codes.InvalidArgument, "metric %d: %s: %s", first.Index, first.Error.Code, first.Error.Message)
+	}
+	if err := repository.WriteBatch(stream.Context(), s.storage, valid); err != nil {
+		return storageError(err)
+	}
+	return stream.SendAndClose(&metricspb.UpdateBatchResponse{Accepted: int64(report.Accepted)})
+}
+
+// GetValue возвращает текущее значение метрики
+func (s *Server) GetValue(ctx context.Context, req *metricspb.GetValueRequest) (*metricspb.GetValueResponse, error) {
+	if req.GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing metric id")
+	}
+	if err := models.ValidateID(req.GetId()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := models.ValidateLabels(req.GetLabels()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid labels")
+	}
+	key := models.SeriesID(req.GetId(), req.GetLabels())
+	m := &metricspb.Metric{Id: req.GetId(), Type: req.GetType(), Labels: req.GetLabels()}
+
+	var err error
+	if req.GetType() == metricspb.Metric_COUNTER {
+		m.Delta, err = s.storage.GetCounter(ctx, key)
+	} else {
+		m.Value, err = s.storage.GetGauge(ctx, key)
+	}
+	if err != nil {
+		return nil, storageError(err)
+	}
+	return &metricspb.GetValueResponse{Metric: m}, nil
+}
+
+// List возвращает все метрики, содержащие метки из фильтра: сначала gauge, затем counter, по имени серии
+func (s *Server) List(ctx context.Context, req *metricspb.ListRequest) (*metricspb.ListResponse, error) {
+	gauges, counters, err := s.storage.GetAllMetrics(ctx)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	filter := models.Labels(req.GetLabels())
+
+	resp := &metricspb.ListResponse{}
+	for _, key := range sortedKeys(gauges) {
+		id, labels := models.ParseSeriesID(key)
+		if labels.Match(filter) {
+			resp.Metrics = append(resp.Metrics, &metricspb.Metric{Id: id, Type: metricspb.Metric_GAUGE, Value: gauges[key], Labels: labels})
+		}
+	}
+	for _, key := range sortedKeys(counters) {
+		id, labels := models.ParseSeriesID(key)
+		if labels.Match(filter) {
+			resp.Metrics = append(resp.Metrics, &metricspb.Metric{Id: id, Type: metricspb.Metric_COUNTER, Delta: counters[key], Labels: labels})
+		}
+	}
+	return resp, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// storageError переводит ошибку хранилища в gRPC-статус: NotFound, Unavailable (клиент может повторить) или Internal
+func storageError(err error) error {
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		return status.Error(codes.NotFound, "metric not found")
+	case errors.Is(err, repository.ErrUnavailable):
+		return status.Error(codes.Unavailable, "storage unavailable")
+	case errors.Is(err, repository.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, "storage timeout")
+	}
+	return status.Error(codes.Internal, "storage error")
+}
@@ -0,0 +1,129 @@
+package grpcapi
+
+import (
+	"context"
+	"math"
+	"net"
+	"testing"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/metricspb"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func startTestServer(t *testing.T, storage repository.Storage, serverKey, clientKey string) metricspb.MetricsClient {
+	ln := bufconn.Listen(1 << 20)
+	srv := NewGRPCServer(storage, serverKey)
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return ln.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(UnaryClientHMAC(clientKey)),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return metricspb.NewMetricsClient(conn)
+}
+
+func TestMetricsService(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	client := startTestServer(t, storage, "secret", "secret")
+
+	var header metadata.MD
+	resp, err := client.Update(ctx, &metricspb.UpdateRequest{Metric: &metricspb.Metric{
+		Id: "PollCount", Type: metricspb.Metric_COUNTER, Delta: 3,
+	}}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), resp.GetMetric().GetDelta())
+	assert.NotEmpty(t, header.Get(HashMetadataKey), "ответ подписан")
+
+	// пакет из двух частей, подпись покрывает весь поток
+	parts := []*metricspb.UpdateBatchRequest{
+		{Metrics: []*metricspb.Metric{{Id: "Alloc", Value: 1.5}, {Id: "PollCount", Type: metricspb.Metric_COUNTER, Delta: 2}}},
+		{Metrics: []*metricspb.Metric{{Id: "Temp", Value: 36.6, Labels: map[string]string{"host": "a"}}}},
+	}
+	signed, err := SignContext(ctx, "secret", parts[0], parts[1])
+	require.NoError(t, err)
+	stream, err := client.UpdateBatch(signed)
+	require.NoError(t, err)
+	for _, p := range parts {
+		require.NoError(t, stream.Send(p))
+	}
+	batchResp, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), batchResp.GetAccepted())
+
+	v, err := client.GetValue(ctx, &metricspb.GetValueRequest{Id: "PollCount", Type: metricspb.Metric_COUNTER})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), v.GetMetric().GetDelta())
+
+	_, err = client.GetValue(ctx, &metricspb.GetValueRequest{Id: "Missing"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	list, err := client.List(ctx, &metricspb.ListRequest{Labels: map[string]string{"host": "a"}})
+	require.NoError(t, err)
+	require.Len(t, list.GetMetrics(), 1)
+	assert.Equal(t, "Temp", list.GetMetrics()[0].GetId())
+	assert.Equal(t, 36.6, list.GetMetrics()[0].GetValue())
+
+	// подпись не сходится — пакет не применяется
+	signed, err = SignContext(ctx, "wrong", parts[0])
+	require.NoError(t, err)
+	stream, err = client.UpdateBatch(signed)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(parts[0]))
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	alloc, _ := storage.GetGauge(ctx, "Alloc")
+	assert.Equal(t, 1.5, alloc)
+	pc, _ := storage.GetCounter(ctx, "PollCount")
+	assert.Equal(t, int64(5), pc)
+}
+
+func TestUnaryWrongKeyRejected(t *testing.T) {
+	client := startTestServer(t, repository.NewMemStorage(), "secret", "other")
+	_, err := client.Update(context.Background(), &metricspb.UpdateRequest{Metric: &metricspb.Metric{Id: "Alloc", Value: 1}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// Проверка та же, что у HTTP: нефинитный gauge, неизвестный тип и некорректный id отклоняются
+func TestInvalidMetricsRejected(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	client := startTestServer(t, storage, "", "")
+
+	for _, m := range []*metricspb.Metric{
+		{Id: "Alloc", Value: math.NaN()},
+		{Id: "Alloc", Value: math.Inf(1)},
+		{Id: "Alloc", Type: metricspb.Metric_MType(7), Value: 1},
+		{Id: "bad{id", Value: 1},
+	} {
+		_, err := client.Update(ctx, &metricspb.UpdateRequest{Metric: m})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), m.String())
+	}
+
+	// одна нефинитная метрика отклоняет весь пакет
+	stream, err := client.UpdateBatch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&metricspb.UpdateBatchRequest{Metrics: []*metricspb.Metric{
+		{Id: "Temp", Value: 36.6},
+		{Id: "Alloc", Value: math.Inf(-1)},
+	}}))
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = storage.GetGauge(ctx, "Temp")
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+
+	_, err = client.GetValue(ctx, &metricspb.GetValueRequest{Id: "bad{id"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
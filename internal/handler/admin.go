@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"go.uber.org/zap"
+)
+
+// AdminRequest — тело /api/v1/admin/delete и /api/v1/admin/reset:
+// id (с метками) выбирает одну серию, prefix — все серии с таким началом ID
+type AdminRequest struct {
+	MType  string        `json:"type,omitempty"`
+	ID     string        `json:"id,omitempty"`
+	Labels models.Labels `json:"labels,omitempty"`
+	Prefix string        `json:"prefix,omitempty"`
+}
+
+// AdminResponse — число удалённых или обнулённых серий
+type AdminResponse struct {
+	Deleted *int `json:"deleted,omitempty"`
+	Reset   *int `json:"reset,omitempty"`
+}
+
+// DeleteHandler — POST /api/v1/admin/delete. Без type удаляются серии обоих типов.
+// persist вызывается после изменения — чтобы удаление попало в файловый снапшот; может быть nil.
+func DeleteHandler(d repository.Deleter, persist func() error, key string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sel, ok := decodeSelector(w, r, true)
+		if !ok {
+			return
+		}
+		n, err := d.DeleteMetrics(r.Context(), sel)
+		if !adminDone(w, n, err, sel, persist) {
+			return
+		}
+		_ = WriteSignedJSONResponse(w, AdminResponse{Deleted: &n}, key)
+	}
+}
+
+// ResetHandler — POST /api/v1/admin/reset: обнуляет counter, type указывать не нужно
+func ResetHandler(d repository.Deleter, persist func() error, key string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sel, ok := decodeSelector(w, r, false)
+		if !ok {
+			return
+		}
+		n, err := d.ResetCounters(r.Context(), sel)
+		if !adminDone(w, n, err, sel, persist) {
+			return
+		}
+		_ = WriteSignedJSONResponse(w, AdminResponse{Reset: &n}, key)
+	}
+}
+
+// decodeSelector читает и проверяет AdminRequest; ответ с ошибкой уже отправлен, если ok == false
+func decodeSelector(w http.ResponseWriter, r *http.Request, anyType bool) (repository.Selector, bool) {
+	defer r.Body.Close()
+
+	var req AdminRequest
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		WriteError(w, http.StatusBadRequest, CodeInvalidJSON, "invalid json: "+err.Error())
+		return repository.Selector{}, false
+	}
+
+	if !anyType {
+		req.MType = models.Counter
+	}
+	if req.MType != "" && req.MType != models.Gauge && req.MType != models.Counter {
+		WriteInvalid(w, unknownType(req.MType))
+		return repository.Selector{}, false
+	}
+
+	switch {
+	case req.ID != "" && req.Prefix != "":
+		WriteError(w, http.StatusBadRequest, CodeInvalidBody, "id and prefix are mutually exclusive")
+	case req.Prefix != "":
+		if err := models.ValidateID(req.Prefix); err != nil {
+			WriteError(w, http.StatusBadRequest, CodeInvalidID, err.Error())
+			break
+		}
+		if len(req.Labels) > 0 {
+			WriteError(w, http.StatusBadRequest, CodeInvalidBody, "labels are not allowed with prefix")
+			break
+		}
+		return repository.Selector{MType: req.MType, Prefix: req.Prefix}, true
+	case req.ID != "":
+		if err := models.ValidateID(req.ID); err != nil {
+			WriteError(w, http.StatusBadRequest, CodeInvalidID, err.Error())
+			break
+		}
+		if err := models.ValidateLabels(req.Labels); err != nil {
+			WriteError(w, http.StatusBadRequest, CodeInvalidLabels, err.Error())
+			break
+		}
+		return repository.Selector{MType: req.MType, Series: models.SeriesID(req.ID, req.Labels)}, true
+	default:
+		// пустой префикс выбрал бы всё хранилище — такое делается только явно
+		WriteError(w, http.StatusBadRequest, CodeMissingID, "id or prefix is required")
+	}
+	return repository.Selector{}, false
+}
+
+// adminDone обрабатывает результат операции: ошибка хранилища, промах по конкретной серии, сохранение снапшота
+func adminDone(w http.ResponseWriter, n int, err error, sel repository.Selector, persist func() error) bool {
+	if err != nil {
+		WriteStorageError(w, err)
+		return false
+	}
+	if n == 0 && sel.Series != "" {
+		WriteError(w, http.StatusNotFound, CodeNotFound, "metric not found")
+		return false
+	}
+	if n > 0 && persist != nil {
+		// изменение в хранилище уже применено — ошибку снапшота только логируем
+		if err := persist(); err != nil {
+			logger.Log.Error("save snapshot after admin operation", zap.Error(err))
+		}
+	}
+	return true
+}
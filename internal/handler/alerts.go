@@ -0,0 +1,14 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/alert"
+)
+
+// AlertsHandler — GET /api/v1/alerts: текущее состояние правил алертов (inactive, pending, firing)
+func AlertsHandler(engine *alert.Engine, key string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = WriteSignedJSONResponse(w, engine.Alerts(), key)
+	}
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+)
+
+// Статусы метрик в отчёте о пакете
+const (
+	ItemAccepted  = "accepted"
+	ItemRejected  = "rejected"
+	ItemDuplicate = "duplicate" // gauge перезаписан более поздним значением той же серии из этого же пакета
+)
+
+// ItemResult — результат проверки одной метрики пакета
+type ItemResult struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"`
+	Error  *Error `json:"error,omitempty"`
+}
+
+// BatchReport — отчёт о пакете: сколько метрик записано, отклонено и пропущено как повтор
+type BatchReport struct {
+	Accepted   int          `json:"accepted"`
+	Rejected   int          `json:"rejected"`
+	Duplicates int          `json:"duplicates"`
+	Items      []ItemResult `json:"items"`
+}
+
+// ValidateBatch проверяет каждую метрику пакета и возвращает отчёт и метрики для записи в хранилище.
+// Решение принимается здесь, а не в хранилище, поэтому результат не зависит от backend'а.
+// Повтор серии gauge: записывается последнее значение, ранние помечаются duplicate;
+// повторы counter складываются и принимаются все.
+func ValidateBatch(batch []models.Metrics) (BatchReport, []models.Metrics) {
+	report := BatchReport{Items: make([]ItemResult, len(batch))}
+
+	// последний индекс каждой корректной серии gauge
+	lastGauge := make(map[string]int)
+	for i, m := range batch {
+		report.Items[i] = ItemResult{Index: i, ID: m.ID, Status: ItemAccepted}
+		if e := ValidateMetric(m); e != nil {
+			report.Items[i].Status = ItemRejected
+			report.Items[i].Error = e
+			continue
+		}
+		if m.MType == models.Gauge {
+			lastGauge[m.SeriesID()] = i
+		}
+	}
+
+	valid := make([]models.Metrics, 0, len(batch))
+	for i, m := range batch {
+		item := &report.Items[i]
+		switch {
+		case item.Status == ItemRejected:
+			report.Rejected++
+		case m.MType == models.Gauge && lastGauge[m.SeriesID()] != i:
+			item.Status = ItemDuplicate
+			report.Duplicates++
+		default:
+			report.Accepted++
+			valid = append(valid, m)
+		}
+	}
+	return report, valid
+}
+
+// FirstRejected возвращает первую отклонённую метрику отчёта
+func (r BatchReport) FirstRejected() (ItemResult, bool) {
+	for _, item := range r.Items {
+		if item.Status == ItemRejected {
+			return item, true
+		}
+	}
+	return ItemResult{}, false
+}
+
+// RejectedItems возвращает только отклонённые метрики — для ответа с ошибкой
+func (r BatchReport) RejectedItems() []ItemResult {
+	out := make([]ItemResult, 0, r.Rejected)
+	for _, item := range r.Items {
+		if item.Status == ItemRejected {
+			out = append(out, item)
+		}
+	}
+	return out
+}
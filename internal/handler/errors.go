@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"go.uber.org/zap"
+)
+
+// Коды ошибок API — стабильные строки для клиентов; текст message может меняться
+const (
+	CodeInvalidJSON      = "invalid_json"
+	CodeInvalidBody      = "invalid_body"
+	CodeUnsupportedMedia = "unsupported_media_type"
+	CodeInvalidParam     = "invalid_parameter"
+	CodeMissingID        = "missing_id"
+	CodeInvalidID        = "invalid_id"
+	CodeUnknownType      = "unknown_type"
+	CodeMissingValue     = "missing_value"
+	CodeInvalidValue     = "invalid_value"
+	CodeInvalidLabels    = "invalid_labels"
+	CodeEmptyBatch       = "empty_batch"
+	CodeInvalidSignature = "invalid_signature"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeNotImplemented   = "not_implemented"
+	CodeStorage          = "storage_error"
+	CodeUnavailable      = "storage_unavailable"
+	CodeTimeout          = "storage_timeout"
+	CodeInternal         = "internal_error"
+)
+
+// Error — описание ошибки в ответе API. Index — номер метрики в пакете, из-за которой отклонён запрос.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Index   *int   `json:"index,omitempty"`
+}
+
+// ErrorResponse — тело ответа с ошибкой: {"error":{"code":"...","message":"..."}}.
+// Для отклонённого пакета Items перечисляет все некорректные метрики, Error — первую из них.
+type ErrorResponse struct {
+	Error Error        `json:"error"`
+	Items []ItemResult `json:"items,omitempty"`
+}
+
+// WriteError отправляет ошибку в едином JSON-формате
+func WriteError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorResponse(w, status, Error{Code: code, Message: message})
+}
+
+// WriteInvalid отправляет ошибку проверки метрики (400)
+func WriteInvalid(w http.ResponseWriter, e *Error) {
+	writeErrorResponse(w, http.StatusBadRequest, *e)
+}
+
+// WriteBatchRejected отправляет отказ в пакете (400): первая ошибка с номером метрики и список всех отклонённых
+func WriteBatchRejected(w http.ResponseWriter, report BatchReport) {
+	first, ok := report.FirstRejected()
+	if !ok {
+		WriteError(w, http.StatusBadRequest, CodeEmptyBatch, "no metrics to write")
+		return
+	}
+	e := *first.Error
+	e.Index = &first.Index
+	writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: e, Items: report.RejectedItems()})
+}
+
+// retryAfter — через сколько секунд клиенту стоит повторить запрос, если хранилище недоступно
+const retryAfter = "5"
+
+// WriteStorageError отвечает на ошибку хранилища: недоступный backend — 503 с Retry-After,
+// ErrNotFound — 404, остальное — 500
+func WriteStorageError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		WriteError(w, http.StatusNotFound, CodeNotFound, "metric not found")
+	case errors.Is(err, repository.ErrUnavailable):
+		logger.Log.Warn("storage unavailable", zap.Error(err))
+		w.Header().Set("Retry-After", retryAfter)
+		WriteError(w, http.StatusServiceUnavailable, CodeUnavailable, "storage unavailable")
+	case errors.Is(err, repository.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		// запрос не уложился в дедлайн (statement timeout и т.п.) — хранилище при этом доступно
+		logger.Log.Warn("storage timeout", zap.Error(err))
+		WriteError(w, http.StatusGatewayTimeout, CodeTimeout, "storage timeout")
+	default:
+		logger.Log.Error("storage error", zap.Error(err))
+		WriteError(w, http.StatusInternalServerError, CodeStorage, "storage error")
+	}
+}
+
+func writeErrorResponse(w http.ResponseWriter, status int, e Error) {
+	writeJSON(w, status, ErrorResponse{Error: e})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// NotFound и MethodNotAllowed — ответы роутера для неизвестных маршрутов /api/v1
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	WriteError(w, http.StatusNotFound, CodeNotFound, "route not found")
+}
+
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	WriteError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
+}
+
+// ValidateMetric проверяет метрику на запись: ID, тип, наличие значения и метки.
+// Ошибка всегда означает 400 Bad Request.
+func ValidateMetric(m models.Metrics) *Error {
+	if m.ID == "" {
+		return &Error{Code: CodeMissingID, Message: "metric id is required"}
+	}
+	if err := models.ValidateID(m.ID); err != nil {
+		return &Error{Code: CodeInvalidID, Message: err.Error()}
+	}
+	if err := models.ValidateLabels(m.Labels); err != nil {
+		return &Error{Code: CodeInvalidLabels, Message: err.Error()}
+	}
+	switch m.MType {
+	case models.Gauge:
+		if m.Value == nil {
+			return &Error{Code: CodeMissingValue, Message: "gauge without value"}
+		}
+		if math.IsNaN(*m.Value) || math.IsInf(*m.Value, 0) {
+			return &Error{Code: CodeInvalidValue, Message: "gauge value must be finite"}
+		}
+	case models.Counter:
+		if m.Delta == nil {
+			return &Error{Code: CodeMissingValue, Message: "counter without delta"}
+		}
+	default:
+		return unknownType(m.MType)
+	}
+	return nil
+}
+
+// ValidateMetricKey проверяет метрику на чтение: значение не требуется
+func ValidateMetricKey(m models.Metrics) *Error {
+	if m.ID == "" {
+		return &Error{Code: CodeMissingID, Message: "metric id is required"}
+	}
+	if err := models.ValidateID(m.ID); err != nil {
+		return &Error{Code: CodeInvalidID, Message: err.Error()}
+	}
+	if err := models.ValidateLabels(m.Labels); err != nil {
+		return &Error{Code: CodeInvalidLabels, Message: err.Error()}
+	}
+	if m.MType != models.Gauge && m.MType != models.Counter {
+		return unknownType(m.MType)
+	}
+	return nil
+}
+
+func unknownType(mtype string) *Error {
+	return &Error{Code: CodeUnknownType, Message: "unknown metric type " + strconv.Quote(mtype)}
+}
@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/ingest"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+)
+
+// InfluxWriteHandler — POST /api/v2/write: приём метрик в формате InfluxDB line protocol (например, от Telegraf).
+// Тело целиком пишется одним пакетом; при ошибке разбора не пишется ничего. Gzip распаковывает middleware.
+// Поля с суффиксами counterSuffixes — накопительные счётчики: в хранилище пишется прирост с прошлой записи.
+func InfluxWriteHandler(storage repository.Storage, counterSuffixes []string) http.HandlerFunc {
+	cumulative := ingest.NewCumulative()
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		// небольшая защита от больших тел
+		limited := io.LimitReader(r.Body, 10<<20) // 10MB
+
+		batch, err := ingest.ParseInfluxLines(limited, counterSuffixes)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, CodeInvalidBody, err.Error())
+			return
+		}
+		if len(batch) > 0 {
+			batch, commit := cumulative.Deltas(batch)
+			if err := repository.WriteBatch(r.Context(), storage, batch); err != nil {
+				WriteStorageError(w, err)
+				return
+			}
+			commit()
+		}
+
+		// как и InfluxDB, успешная запись — 204 без тела
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
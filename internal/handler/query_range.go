@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+)
+
+// диапазон по умолчанию, если from не задан
+const defaultQueryRange = time.Hour
+
+// QueryRangeResponse — ответ GET /api/v1/query_range
+type QueryRangeResponse struct {
+	ID     string              `json:"id"`
+	MType  string              `json:"type"`
+	Labels models.Labels       `json:"labels,omitempty"`
+	From   time.Time           `json:"from"`
+	To     time.Time           `json:"to"`
+	Step   string              `json:"step,omitempty"`
+	Values []repository.Sample `json:"values"`
+}
+
+// QueryRangeHandler — GET /api/v1/query_range?id=...&type=...&from=...&to=...&step=...&label=host=a
+// from/to — RFC3339 или unix-время в секундах, step — длительность Go ("15s") или число секунд,
+// label — метки серии (можно несколько).
+func QueryRangeHandler(history repository.HistoryReader, key string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		id := q.Get("id")
+		if id == "" {
+			WriteError(w, http.StatusBadRequest, CodeMissingID, "missing id")
+			return
+		}
+		if err := models.ValidateID(id); err != nil {
+			WriteError(w, http.StatusBadRequest, CodeInvalidID, err.Error())
+			return
+		}
+
+		labels, err := models.ParseLabelFilter(q["label"])
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, CodeInvalidLabels, "invalid label filter")
+			return
+		}
+
+		mtype := q.Get("type")
+		if mtype == "" {
+			mtype = "gauge"
+		}
+		if mtype != "gauge" && mtype != "counter" {
+			WriteError(w, http.StatusBadRequest, CodeUnknownType, "unknown metric type")
+			return
+		}
+
+		to := time.Now()
+		if v := q.Get("to"); v != "" {
+			t, err := parseQueryTime(v)
+			if err != nil {
+				WriteError(w, http.StatusBadRequest, CodeInvalidParam, "invalid to")
+				return
+			}
+			to = t
+		}
+
+		from := to.Add(-defaultQueryRange)
+		if v := q.Get("from"); v != "" {
+			t, err := parseQueryTime(v)
+			if err != nil {
+				WriteError(w, http.StatusBadRequest, CodeInvalidParam, "invalid from")
+				return
+			}
+			from = t
+		}
+		if from.After(to) {
+			WriteError(w, http.StatusBadRequest, CodeInvalidParam, "from must not be after to")
+			return
+		}
+
+		var step time.Duration
+		if v := q.Get("step"); v != "" {
+			d, err := parseQueryStep(v)
+			if err != nil || d <= 0 {
+				WriteError(w, http.StatusBadRequest, CodeInvalidParam, "invalid step")
+				return
+			}
+			step = d
+		}
+
+		samples, err := history.QueryRange(r.Context(), mtype, models.SeriesID(id, labels), from, to, step)
+		if err != nil {
+			if errors.Is(err, repository.ErrHistoryDisabled) {
+				WriteError(w, http.StatusNotImplemented, CodeNotImplemented, "history is disabled")
+				return
+			}
+			WriteStorageError(w, err)
+			return
+		}
+
+		resp := QueryRangeResponse{
+			ID:     id,
+			MType:  mtype,
+			Labels: labels,
+			From:   from,
+			To:     to,
+			Values: samples,
+		}
+		if step > 0 {
+			resp.Step = step.String()
+		}
+		_ = WriteSignedJSONResponse(w, resp, key)
+	}
+}
+
+// parseQueryTime разбирает RFC3339 или unix-время (секунды, допускается дробная часть)
+func parseQueryTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	sec, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(sec) || math.IsInf(sec, 0) {
+		return time.Time{}, errors.New("invalid time")
+	}
+	whole, frac := math.Modf(sec)
+	return time.Unix(int64(whole), int64(frac*1e9)), nil
+}
+
+// parseQueryStep разбирает длительность Go или число секунд
+func parseQueryStep(v string) (time.Duration, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return d, nil
+	}
+	sec, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(sec * float64(time.Second)), nil
+}
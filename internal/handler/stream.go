@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/stream"
+)
+
+// streamHeartbeat — период комментария-пинга, чтобы прокси не закрывали простаивающий поток
+const streamHeartbeat = 15 * time.Second
+
+// StreamHandler — GET /api/v1/stream?id=CPU*&type=gauge&label=host=a: принятые обновления метрик
+// в формате Server-Sent Events. id — шаблон path.Match (можно несколько), type и label — как в остальном API.
+// События: `update` с метрикой; `dropped` с числом вытесненных событий, если клиент не успевает читать.
+func StreamHandler(hub *stream.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		filter := stream.Filter{IDPatterns: q["id"], MType: q.Get("type")}
+		for _, p := range filter.IDPatterns {
+			if _, err := path.Match(p, ""); err != nil {
+				WriteError(w, http.StatusBadRequest, CodeInvalidParam, "invalid id pattern")
+				return
+			}
+		}
+		if filter.MType != "" && filter.MType != models.Gauge && filter.MType != models.Counter {
+			WriteError(w, http.StatusBadRequest, CodeUnknownType, "unknown metric type")
+			return
+		}
+		labels, err := models.ParseLabelFilter(q["label"])
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, CodeInvalidLabels, "invalid label filter")
+			return
+		}
+		filter.Labels = labels
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			return // запись без сброса буфера не годится для потока
+		}
+
+		sub := hub.Subscribe(filter)
+		defer hub.Unsubscribe(sub)
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-hub.Done():
+				return
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+			case e := <-sub.Events():
+				if n := sub.Dropped(); n > 0 {
+					if _, err := fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", n); err != nil {
+						return
+					}
+				}
+				data, err := json.Marshal(e)
+				if err != nil {
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: update\ndata: %s\n\n", data); err != nil {
+					return
+				}
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
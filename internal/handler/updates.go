@@ -4,60 +4,60 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"strconv"
 
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
 )
 
+// UpdatesHandler — POST /updates: пакет метрик в JSON. Проверка пакета — ValidateBatch,
+// с ?partial=true ответом служит BatchReport.
 func UpdatesHandler(storage repository.Storage, key string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 
 		if ct := r.Header.Get("Content-Type"); ct != "" && ct != "application/json" {
-			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			WriteError(w, http.StatusUnsupportedMediaType, CodeUnsupportedMedia, "Content-Type must be application/json")
 			return
 		}
 
+		partial := false
+		if v := r.URL.Query().Get("partial"); v != "" {
+			var err error
+			if partial, err = strconv.ParseBool(v); err != nil {
+				WriteError(w, http.StatusBadRequest, CodeInvalidParam, "invalid partial")
+				return
+			}
+		}
+
 		// небольшая защита от больших тел
 		limited := io.LimitReader(r.Body, 10<<20) // 10MB
 
 		var batch []models.Metrics
 		if err := json.NewDecoder(limited).Decode(&batch); err != nil {
-			http.Error(w, "bad json", http.StatusBadRequest)
+			WriteError(w, http.StatusBadRequest, CodeInvalidJSON, "invalid json: "+err.Error())
 			return
 		}
 		if len(batch) == 0 {
-			http.Error(w, "empty batch", http.StatusBadRequest)
+			WriteError(w, http.StatusBadRequest, CodeEmptyBatch, "empty batch")
 			return
 		}
 
-		// Если хранилище умеет атомарный батч — используем его
-		if bu, ok := storage.(repository.BatchUpdater); ok {
-			if err := bu.UpdateBatch(r.Context(), batch); err != nil {
-				http.Error(w, "storage error", http.StatusInternalServerError)
-				return
-			}
-		} else {
-			// Фолбэк: поштучно
-			for _, m := range batch {
-				switch m.MType {
-				case "gauge":
-					if m.Value == nil {
-						http.Error(w, "gauge without value", http.StatusBadRequest)
-						return
-					}
-					storage.UpdateGauge(r.Context(), m.ID, *m.Value)
-				case "counter":
-					if m.Delta == nil {
-						http.Error(w, "counter without delta", http.StatusBadRequest)
-						return
-					}
-					storage.UpdateCounter(r.Context(), m.ID, *m.Delta)
-				default:
-					http.Error(w, "unknown mtype", http.StatusBadRequest)
-					return
-				}
-			}
+		// по умолчанию пакет применяется целиком или не применяется вовсе;
+		// с ?partial=true записываются корректные метрики, а в ответе — статус каждой
+		report, valid := ValidateBatch(batch)
+		if report.Rejected > 0 && (!partial || len(valid) == 0) {
+			WriteBatchRejected(w, report)
+			return
+		}
+
+		if err := repository.WriteBatch(r.Context(), storage, valid); err != nil {
+			WriteStorageError(w, err)
+			return
+		}
+		if partial {
+			_ = WriteSignedJSONResponse(w, report, key)
+			return
 		}
 
 		// w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,163 @@
+// Package ingest принимает метрики по сторонним протоколам (StatsD, Graphite, Influx line protocol)
+// и пишет их в repository.Storage пакетами.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"go.uber.org/zap"
+)
+
+// bufferedGauge — значение gauge за интервал; relative — только прирост к текущему значению в хранилище
+type bufferedGauge struct {
+	value    float64
+	relative bool
+}
+
+// Buffer копит обновления между сбросами, чтобы всплеск пакетов превращался в одну запись в хранилище:
+// у gauge остаётся последнее значение, counter суммируются. Ключи — серии (models.SeriesID).
+type Buffer struct {
+	mu       sync.Mutex
+	gauges   map[string]bufferedGauge
+	counters map[string]float64 // дробные приросты (sample rate) округляются при сбросе
+}
+
+func NewBuffer() *Buffer {
+	return &Buffer{
+		gauges:   make(map[string]bufferedGauge),
+		counters: make(map[string]float64),
+	}
+}
+
+// Gauge запоминает значение gauge
+func (b *Buffer) Gauge(key string, v float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.gauges[key] = bufferedGauge{value: v}
+}
+
+// GaugeDelta изменяет gauge на d относительно последнего значения
+func (b *Buffer) GaugeDelta(key string, d float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g, ok := b.gauges[key]
+	if !ok {
+		g.relative = true
+	}
+	g.value += d
+	b.gauges[key] = g
+}
+
+// Counter добавляет прирост counter
+func (b *Buffer) Counter(key string, d float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.counters[key] += d
+}
+
+// Flush записывает накопленное в storage одним пакетом и очищает буфер
+func (b *Buffer) Flush(ctx context.Context, storage repository.Storage) error {
+	b.mu.Lock()
+	gauges, counters := b.gauges, b.counters
+	b.gauges = make(map[string]bufferedGauge)
+	b.counters = make(map[string]float64)
+	b.mu.Unlock()
+
+	batch := make([]models.Metrics, 0, len(gauges)+len(counters))
+	var readErr error
+	deferred := make(map[string]bufferedGauge) // приросты gauge, для которых не удалось прочитать текущее значение
+	for key, g := range gauges {
+		v := g.value
+		if g.relative {
+			cur, err := storage.GetGauge(ctx, key)
+			if err != nil && !errors.Is(err, repository.ErrNotFound) {
+				deferred[key] = g
+				readErr = err
+				continue
+			}
+			v += cur
+		}
+		batch = append(batch, models.SeriesMetric(key, models.Gauge, v, 0))
+	}
+	remainders := make(map[string]float64)
+	for key, sum := range counters {
+		d := int64(math.Round(sum))
+		if rem := sum - float64(d); rem != 0 {
+			remainders[key] = rem // дробная часть переносится в следующий интервал
+		}
+		if d == 0 {
+			continue
+		}
+		batch = append(batch, models.SeriesMetric(key, models.Counter, 0, d))
+	}
+	if len(remainders) > 0 {
+		b.mu.Lock()
+		for key, rem := range remainders {
+			b.counters[key] += rem
+		}
+		b.mu.Unlock()
+	}
+	if len(deferred) > 0 {
+		b.mu.Lock()
+		for key, g := range deferred {
+			b.restoreGauge(key, g)
+		}
+		b.mu.Unlock()
+	}
+	if len(batch) > 0 {
+		if err := repository.WriteBatch(ctx, storage, batch); err != nil {
+			// пакет не записан — возвращаем его в буфер, чтобы данные интервала не пропали
+			b.mu.Lock()
+			for key, g := range gauges {
+				if _, ok := deferred[key]; !ok {
+					b.restoreGauge(key, g)
+				}
+			}
+			for key, sum := range counters {
+				b.counters[key] += math.Round(sum) // дробная часть уже возвращена
+			}
+			b.mu.Unlock()
+			return err
+		}
+	}
+	return readErr
+}
+
+// restoreGauge возвращает в буфер gauge из неудавшегося сброса; вызывается под b.mu.
+// Абсолютное значение, пришедшее после сброса, новее и перекрывает возвращённое, прирост добавляется к нему.
+func (b *Buffer) restoreGauge(key string, old bufferedGauge) {
+	g, ok := b.gauges[key]
+	switch {
+	case !ok:
+		b.gauges[key] = old
+	case g.relative:
+		g.value += old.value
+		g.relative = old.relative
+		b.gauges[key] = g
+	}
+}
+
+// RunFlusher вызывает flush каждые every до отмены ctx.
+// Финальный сброс — на вызывающем: его нужно делать после остановки listener'ов.
+func RunFlusher(ctx context.Context, flush func(context.Context) error, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := flush(ctx); err != nil {
+				logger.Log.Error("ingest flush", zap.Error(err))
+			}
+		}
+	}
+}
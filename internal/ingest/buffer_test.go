@@ -0,0 +1,56 @@
+package ingest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// downStorage отклоняет запись пакетов, пока down == true
+type downStorage struct {
+	*repository.MemStorage
+	down bool
+}
+
+func (s *downStorage) UpdateBatch(ctx context.Context, batch []models.Metrics) error {
+	if s.down {
+		return repository.ErrUnavailable
+	}
+	return s.MemStorage.UpdateBatch(ctx, batch)
+}
+
+// Пакет, который не удалось записать, остаётся в буфере и уходит следующим сбросом вместе с новыми данными
+func TestBufferKeepsBatchOnWriteError(t *testing.T) {
+	ctx := context.Background()
+	storage := &downStorage{MemStorage: repository.NewMemStorage(), down: true}
+	require.NoError(t, storage.UpdateGauge(ctx, "queue", 10))
+
+	b := NewBuffer()
+	b.Counter("hits", 3)
+	b.Gauge("temp", 1)
+	b.GaugeDelta("queue", -3)
+	b.Gauge("load", 0.5)
+	assert.ErrorIs(t, b.Flush(ctx, storage), repository.ErrUnavailable)
+
+	// пока хранилище недоступно, пришли новые данные
+	b.Counter("hits", 2)
+	b.Gauge("temp", 2) // абсолютное значение новее возвращённого
+	b.GaugeDelta("queue", -1)
+
+	storage.down = false
+	require.NoError(t, b.Flush(ctx, storage))
+
+	hits, err := storage.GetCounter(ctx, "hits")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), hits)
+	temp, _ := storage.GetGauge(ctx, "temp")
+	assert.Equal(t, 2.0, temp)
+	queue, _ := storage.GetGauge(ctx, "queue")
+	assert.Equal(t, 6.0, queue)
+	load, _ := storage.GetGauge(ctx, "load")
+	assert.Equal(t, 0.5, load)
+}
@@ -0,0 +1,62 @@
+package ingest
+
+import (
+	"maps"
+	"sync"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+)
+
+// Cumulative переводит накопительные значения counter (Prometheus `_total`, Telegraf `_count`) в приросты
+// относительно последнего записанного значения серии. Состояние хранится в памяти процесса.
+type Cumulative struct {
+	mu   sync.Mutex
+	last map[string]int64 // ключ — серия
+}
+
+func NewCumulative() *Cumulative {
+	return &Cumulative{last: make(map[string]int64)}
+}
+
+// Deltas возвращает пакет, в котором Delta у counter заменены приростами. Первое значение серии
+// даёт прирост 0 (серия появляется, но её история до нас неизвестна); уменьшение считается сбросом счётчика
+// и даёт прирост от нуля. Новые значения запоминаются только вызовом commit — после успешной записи пакета,
+// иначе при повторе запроса прирост был бы потерян.
+func (c *Cumulative) Deltas(batch []models.Metrics) ([]models.Metrics, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seen := make(map[string]int64)
+	out := make([]models.Metrics, 0, len(batch))
+	for _, m := range batch {
+		if m.MType != models.Counter || m.Delta == nil {
+			out = append(out, m)
+			continue
+		}
+		key := m.SeriesID()
+		prev, ok := seen[key]
+		if !ok {
+			prev, ok = c.last[key]
+		}
+		cur := *m.Delta
+		seen[key] = cur
+
+		var d int64
+		switch {
+		case !ok:
+		case cur >= prev:
+			d = cur - prev
+		default:
+			d = cur
+		}
+		m.Delta = &d
+		out = append(out, m)
+	}
+
+	commit := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		maps.Copy(c.last, seen)
+	}
+	return out, commit
+}
@@ -0,0 +1,43 @@
+package ingest
+
+import (
+	"testing"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCumulativeDeltas(t *testing.T) {
+	total := func(v int64) models.Metrics {
+		return models.Metrics{ID: "requests_total", MType: models.Counter, Delta: &v, Labels: models.Labels{"host": "a"}}
+	}
+	deltas := func(ms []models.Metrics) []int64 {
+		var out []int64
+		for _, m := range ms {
+			out = append(out, *m.Delta)
+		}
+		return out
+	}
+	c := NewCumulative()
+
+	// первое значение серии — прирост 0, повтор серии в том же пакете считается от предыдущего
+	out, commit := c.Deltas([]models.Metrics{total(10), total(15)})
+	assert.Equal(t, []int64{0, 5}, deltas(out))
+	commit()
+
+	// пакет не записан — значения не запоминаются, повтор даёт тот же прирост
+	out, _ = c.Deltas([]models.Metrics{total(22)})
+	assert.Equal(t, []int64{7}, deltas(out))
+	out, commit = c.Deltas([]models.Metrics{total(22)})
+	assert.Equal(t, []int64{7}, deltas(out))
+	commit()
+
+	// сброс счётчика на источнике
+	out, _ = c.Deltas([]models.Metrics{total(3)})
+	assert.Equal(t, []int64{3}, deltas(out))
+
+	// gauge не меняются
+	v := 1.5
+	out, _ = c.Deltas([]models.Metrics{{ID: "load", MType: models.Gauge, Value: &v}})
+	assert.Equal(t, 1.5, *out[0].Value)
+}
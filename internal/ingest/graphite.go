@@ -0,0 +1,138 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"go.uber.org/zap"
+)
+
+// GraphiteMalformedMetric — counter сервера с числом отброшенных строк Graphite
+const GraphiteMalformedMetric = "GraphiteMalformedLines"
+
+// Graphite принимает строки plaintext-протокола Carbon: `metric.path value [timestamp]`.
+// Путь становится ID метрики, теги Graphite (`path;tag=value`) — метками. Значение пишется в gauge,
+// а для путей с префиксом из counterPrefixes — прибавляется к counter. Timestamp проверяется, но не хранится:
+// в хранилище попадает последнее значение на момент сброса.
+type Graphite struct {
+	buf             *Buffer
+	counterPrefixes []string
+	malformed       atomic.Int64
+	reported        atomic.Int64 // сколько отброшенных строк уже записано в GraphiteMalformedMetric
+}
+
+func NewGraphite(counterPrefixes []string) *Graphite {
+	return &Graphite{
+		buf:             NewBuffer(),
+		counterPrefixes: counterPrefixes,
+	}
+}
+
+// HandleLine разбирает строку; некорректная строка считается и пропускается, соединение не рвётся
+func (g *Graphite) HandleLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	if err := g.parseLine(line); err != nil {
+		g.malformed.Add(1)
+		logger.Log.Debug("graphite: malformed line", zap.String("line", line), zap.Error(err))
+	}
+}
+
+// Malformed возвращает число отброшенных строк с момента запуска
+func (g *Graphite) Malformed() int64 {
+	return g.malformed.Load()
+}
+
+func (g *Graphite) parseLine(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return errors.New("expected `path value [timestamp]`")
+	}
+
+	path, labels, err := parseGraphitePath(fields[0])
+	if err != nil {
+		return err
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("invalid value %q", fields[1])
+	}
+	if len(fields) == 3 && fields[2] != "-1" {
+		if _, err := strconv.ParseFloat(fields[2], 64); err != nil {
+			return fmt.Errorf("invalid timestamp %q", fields[2])
+		}
+	}
+
+	key := models.SeriesID(path, labels)
+	if g.isCounter(path) {
+		g.buf.Counter(key, value)
+	} else {
+		g.buf.Gauge(key, value)
+	}
+	return nil
+}
+
+func (g *Graphite) isCounter(path string) bool {
+	for _, p := range g.counterPrefixes {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseGraphitePath разбирает путь с тегами Graphite 1.1: `disk.used;host=a;dc=eu`
+func parseGraphitePath(s string) (string, models.Labels, error) {
+	path, tags, hasTags := strings.Cut(s, ";")
+	if path == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+		return "", nil, fmt.Errorf("invalid path %q", path)
+	}
+	if err := models.ValidateID(path); err != nil {
+		return "", nil, err
+	}
+	if !hasTags {
+		return path, nil, nil
+	}
+	labels := make(models.Labels)
+	for _, tag := range strings.Split(tags, ";") {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok || v == "" {
+			return "", nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		labels[k] = v
+	}
+	if err := models.ValidateLabels(labels); err != nil {
+		return "", nil, err
+	}
+	return path, labels, nil
+}
+
+// Flush записывает накопленное за интервал в storage вместе с приростом GraphiteMalformedMetric
+func (g *Graphite) Flush(ctx context.Context, storage repository.Storage) error {
+	total := g.malformed.Load()
+	if d := total - g.reported.Swap(total); d > 0 {
+		g.buf.Counter(GraphiteMalformedMetric, float64(d))
+	}
+	return g.buf.Flush(ctx, storage)
+}
+
+// ParseList разбирает список значений через запятую
+func ParseList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
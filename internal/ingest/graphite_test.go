@@ -0,0 +1,62 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Некорректные строки считаются, но не рвут соединение: следующие строки принимаются
+func TestGraphiteServeTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	g := NewGraphite([]string{"stats_counts."})
+	done := make(chan error, 1)
+	go func() { done <- ServeTCP(ctx, ln, g.HandleLine) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	now := time.Now().Unix()
+	fmt.Fprintf(conn, "servers.web1.cpu.load 0.75 %d\n", now)
+	fmt.Fprintf(conn, "not a metric line\n")
+	fmt.Fprintf(conn, "servers.web1.cpu.load abc %d\n", now)
+	fmt.Fprintf(conn, "stats_counts.requests 5 %d\n", now)
+	fmt.Fprintf(conn, "stats_counts.requests 3 %d\n", now)
+	fmt.Fprintf(conn, "disk.used;host=a;dc=eu 42 %d\n", now)
+	fmt.Fprintf(conn, "servers.web1.cpu.load 0.5 -1\n")
+	require.NoError(t, conn.Close())
+
+	storage := repository.NewMemStorage()
+	ctxBg := context.Background()
+	require.Eventually(t, func() bool {
+		require.NoError(t, g.Flush(ctxBg, storage))
+		v, _ := storage.GetGauge(ctxBg, "servers.web1.cpu.load")
+		return v == 0.5
+	}, time.Second, 10*time.Millisecond)
+
+	requests, _ := storage.GetCounter(ctxBg, "stats_counts.requests")
+	assert.Equal(t, int64(8), requests)
+	disk, err := storage.GetGauge(ctxBg, `disk.used{dc="eu",host="a"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 42.0, disk)
+
+	assert.Equal(t, int64(2), g.Malformed())
+	malformed, _ := storage.GetCounter(ctxBg, GraphiteMalformedMetric)
+	assert.Equal(t, int64(2), malformed)
+
+	// счётчик ошибок пишется приростом: повторный сброс его не удваивает
+	require.NoError(t, g.Flush(ctxBg, storage))
+	malformed, _ = storage.GetCounter(ctxBg, GraphiteMalformedMetric)
+	assert.Equal(t, int64(2), malformed)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
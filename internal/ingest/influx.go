@@ -0,0 +1,180 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+)
+
+// ParseInfluxLines разбирает тело в формате InfluxDB line protocol:
+// `measurement[,tag=value...] field=value[,field2=value2...] [timestamp]`.
+// Каждое числовое или логическое поле становится метрикой `measurement_field` с тегами в качестве меток:
+// gauge по умолчанию или counter, если имя оканчивается на один из counterSuffixes. У counter в Delta —
+// значение поля как есть (накопительное); приросты из него считает Cumulative.
+// Строковые поля пропускаются. Ошибка в любой строке отменяет разбор всего тела.
+func ParseInfluxLines(r io.Reader, counterSuffixes []string) ([]models.Metrics, error) {
+	var out []models.Metrics
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 4096), maxLineSize)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ms, err := parseInfluxLine(line, counterSuffixes)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		out = append(out, ms...)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func parseInfluxLine(line string, counterSuffixes []string) ([]models.Metrics, error) {
+	sections := splitUnescaped(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, errors.New("expected `measurement[,tags] fields [timestamp]`")
+	}
+	if len(sections) == 3 {
+		if _, err := strconv.ParseInt(sections[2], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", sections[2])
+		}
+	}
+
+	key := splitUnescaped(sections[0], ',', false)
+	measurement := unescapeInflux(key[0])
+	if measurement == "" {
+		return nil, errors.New("empty measurement")
+	}
+	var labels models.Labels
+	if len(key) > 1 {
+		labels = make(models.Labels, len(key)-1)
+		for _, tag := range key[1:] {
+			kv := splitUnescaped(tag, '=', false)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				return nil, fmt.Errorf("invalid tag %q", tag)
+			}
+			labels[unescapeInflux(kv[0])] = unescapeInflux(kv[1])
+		}
+		if err := models.ValidateLabels(labels); err != nil {
+			return nil, err
+		}
+	}
+
+	var out []models.Metrics
+	for _, field := range splitUnescaped(sections[1], ',', true) {
+		kv := splitUnescaped(field, '=', true)
+		if len(kv) < 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+		raw := strings.Join(kv[1:], "=") // '=' внутри строкового значения
+		value, numeric, err := parseInfluxValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", kv[0], err)
+		}
+		if !numeric {
+			continue
+		}
+
+		id := measurement + "_" + unescapeInflux(kv[0])
+		if err := models.ValidateID(id); err != nil {
+			return nil, err
+		}
+		m := models.Metrics{ID: id, MType: models.Gauge, Labels: labels}
+		if hasAnySuffix(id, counterSuffixes) {
+			d := int64(math.Round(value))
+			m.MType, m.Delta = models.Counter, &d
+		} else {
+			v := value
+			m.Value = &v
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// parseInfluxValue разбирает значение поля: float, целое (`1i`, `1u`) или bool (1/0).
+// Для строкового значения numeric == false.
+func parseInfluxValue(s string) (value float64, numeric bool, err error) {
+	switch {
+	case s == "":
+		return 0, false, errors.New("empty value")
+	case strings.HasPrefix(s, `"`):
+		if len(s) < 2 || !strings.HasSuffix(s, `"`) {
+			return 0, false, errors.New("unterminated string")
+		}
+		return 0, false, nil
+	case strings.HasSuffix(s, "i"):
+		n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return float64(n), true, err
+	case strings.HasSuffix(s, "u"):
+		n, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		return float64(n), true, err
+	}
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false, fmt.Errorf("invalid value %q", s)
+	}
+	return v, true, nil
+}
+
+// splitUnescaped делит s по sep, не считая экранированные `\sep` и, если quoted, — sep внутри кавычек.
+// Экранирование в частях сохраняется.
+func splitUnescaped(s string, sep byte, quoted bool) []string {
+	var parts []string
+	inQuote := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++ // следующий символ экранирован
+		case quoted && c == '"':
+			inQuote = !inQuote
+		case c == sep && !inQuote:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescapeInflux убирает экранирование пробелов, запятых и '=' в именах и тегах
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(` ,="\`, s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func hasAnySuffix(s string, suffixes []string) bool {
+	for _, suf := range suffixes {
+		if strings.HasSuffix(s, suf) {
+			return true
+		}
+	}
+	return false
+}
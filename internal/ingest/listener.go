@@ -0,0 +1,79 @@
+package ingest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"go.uber.org/zap"
+)
+
+// maxLineSize — предел длины строки протокола в TCP-потоке
+const maxLineSize = 64 << 10
+
+// maxDatagramSize — предел размера UDP-пакета
+const maxDatagramSize = 64 << 10
+
+// LineHandler разбирает одну строку протокола
+type LineHandler func(line string)
+
+// ServeTCP принимает соединения на ln и передаёт handle каждую строку, пока не отменён ctx.
+// При отмене ctx listener и открытые соединения закрываются; ServeTCP дожидается их обработчиков.
+func ServeTCP(ctx context.Context, ln net.Listener, handle LineHandler) error {
+	var conns sync.WaitGroup
+	defer conns.Wait()
+
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			defer conn.Close()
+			stopConn := context.AfterFunc(ctx, func() { conn.Close() })
+			defer stopConn()
+
+			sc := bufio.NewScanner(conn)
+			sc.Buffer(make([]byte, 0, 4096), maxLineSize)
+			for sc.Scan() {
+				handle(sc.Text())
+			}
+			if err := sc.Err(); err != nil && ctx.Err() == nil {
+				logger.Log.Debug("ingest connection closed", zap.String("remote", conn.RemoteAddr().String()), zap.Error(err))
+			}
+		}()
+	}
+}
+
+// ServeUDP читает пакеты из conn, пока не отменён ctx; каждая строка пакета передаётся handle
+func ServeUDP(ctx context.Context, conn net.PacketConn, handle LineHandler) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			handle(line)
+		}
+	}
+}
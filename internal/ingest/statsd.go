@@ -0,0 +1,166 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"go.uber.org/zap"
+)
+
+// timerStats — значения таймера за интервал сброса
+type timerStats struct {
+	id     string
+	labels models.Labels
+	count  float64 // число замеров с учётом sample rate
+	sum    float64
+	lower  float64
+	upper  float64
+}
+
+// StatsD принимает строки протокола StatsD: `name:value|type[|@rate][|#tag:value,...]`.
+// Counter (c) и gauge (g) копятся в Buffer; таймеры (ms, h) при сбросе превращаются
+// в counter `name.count` и gauge `name.mean`, `name.lower`, `name.upper`.
+type StatsD struct {
+	buf       *Buffer
+	mu        sync.Mutex
+	timers    map[string]*timerStats
+	malformed atomic.Int64
+}
+
+func NewStatsD() *StatsD {
+	return &StatsD{
+		buf:    NewBuffer(),
+		timers: make(map[string]*timerStats),
+	}
+}
+
+// HandleLine разбирает строку; некорректные строки считаются и пропускаются
+func (s *StatsD) HandleLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	if err := s.parseLine(line); err != nil {
+		s.malformed.Add(1)
+		logger.Log.Debug("statsd: malformed line", zap.String("line", line), zap.Error(err))
+	}
+}
+
+// Malformed возвращает число отброшенных строк с момента запуска
+func (s *StatsD) Malformed() int64 {
+	return s.malformed.Load()
+}
+
+func (s *StatsD) parseLine(line string) error {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return errors.New("missing metric name")
+	}
+	if err := models.ValidateID(name); err != nil {
+		return err
+	}
+	parts := strings.Split(rest, "|")
+	if len(parts) < 2 {
+		return errors.New("missing metric type")
+	}
+	valueStr, mtype := parts[0], parts[1]
+
+	rate := 1.0
+	var labels models.Labels
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			r, err := strconv.ParseFloat(p[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return fmt.Errorf("invalid sample rate %q", p)
+			}
+			rate = r
+		case strings.HasPrefix(p, "#"):
+			l, err := parseStatsDTags(p[1:])
+			if err != nil {
+				return err
+			}
+			labels = l
+		default:
+			return fmt.Errorf("unknown section %q", p)
+		}
+	}
+
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("invalid value %q", valueStr)
+	}
+	key := models.SeriesID(name, labels)
+
+	switch mtype {
+	case "c":
+		s.buf.Counter(key, value/rate)
+	case "g":
+		// знак перед значением означает изменение относительно текущего gauge
+		if strings.HasPrefix(valueStr, "+") || strings.HasPrefix(valueStr, "-") {
+			s.buf.GaugeDelta(key, value)
+		} else {
+			s.buf.Gauge(key, value)
+		}
+	case "ms", "h":
+		s.addTimer(key, name, labels, value, 1/rate)
+	default:
+		return fmt.Errorf("unsupported metric type %q", mtype)
+	}
+	return nil
+}
+
+// parseStatsDTags разбирает теги DogStatsD `tag:value,tag2` в метки
+func parseStatsDTags(s string) (models.Labels, error) {
+	labels := make(models.Labels)
+	for _, tag := range strings.Split(s, ",") {
+		if tag == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(tag, ":")
+		labels[k] = v
+	}
+	if err := models.ValidateLabels(labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+func (s *StatsD) addTimer(key, id string, labels models.Labels, v, count float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.timers[key]
+	if !ok {
+		t = &timerStats{id: id, labels: labels, lower: v, upper: v}
+		s.timers[key] = t
+	}
+	t.count += count
+	t.sum += v * count
+	t.lower = min(t.lower, v)
+	t.upper = max(t.upper, v)
+}
+
+// Flush переводит таймеры в метрики и записывает всё накопленное за интервал в storage
+func (s *StatsD) Flush(ctx context.Context, storage repository.Storage) error {
+	s.mu.Lock()
+	timers := s.timers
+	s.timers = make(map[string]*timerStats)
+	s.mu.Unlock()
+
+	for _, t := range timers {
+		s.buf.Counter(models.SeriesID(t.id+".count", t.labels), t.count)
+		s.buf.Gauge(models.SeriesID(t.id+".mean", t.labels), t.sum/t.count)
+		s.buf.Gauge(models.SeriesID(t.id+".lower", t.labels), t.lower)
+		s.buf.Gauge(models.SeriesID(t.id+".upper", t.labels), t.upper)
+	}
+	return s.buf.Flush(ctx, storage)
+}
@@ -0,0 +1,119 @@
+package ingest
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsDAggregatesUntilFlush(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+	storage.UpdateGauge(ctx, "queue", 10)
+
+	s := NewStatsD()
+	for _, line := range []string{
+		"hits:1|c",
+		"hits:2|c|@0.5", // с учётом sample rate — 4
+		"temp:36.6|g",
+		"temp:37.2|g", // остаётся последнее значение
+		"queue:-3|g",  // относительно значения в хранилище
+		"req:100|ms",
+		"req:300|ms|@0.5", // 2 замера
+		"errors:1|c|#host:a,env:prod",
+		"bad line",
+		"x:1|s", // set не поддерживается
+		"y:abc|c",
+		"",
+	} {
+		s.HandleLine(line)
+	}
+	assert.Equal(t, int64(3), s.Malformed())
+
+	// до сброса хранилище не трогается
+	_, err := storage.GetCounter(ctx, "hits")
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+
+	require.NoError(t, s.Flush(ctx, storage))
+
+	hits, _ := storage.GetCounter(ctx, "hits")
+	assert.Equal(t, int64(5), hits)
+	temp, _ := storage.GetGauge(ctx, "temp")
+	assert.Equal(t, 37.2, temp)
+	queue, _ := storage.GetGauge(ctx, "queue")
+	assert.Equal(t, 7.0, queue)
+	count, _ := storage.GetCounter(ctx, "req.count")
+	assert.Equal(t, int64(3), count)
+	mean, _ := storage.GetGauge(ctx, "req.mean")
+	assert.InDelta(t, 700.0/3, mean, 1e-9)
+	upper, _ := storage.GetGauge(ctx, "req.upper")
+	assert.Equal(t, 300.0, upper)
+	labeled, err := storage.GetCounter(ctx, `errors{env="prod",host="a"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), labeled)
+
+	// повторный сброс без новых данных ничего не меняет
+	require.NoError(t, s.Flush(ctx, storage))
+	hits, _ = storage.GetCounter(ctx, "hits")
+	assert.Equal(t, int64(5), hits)
+}
+
+// NaN и Inf отбрасываются как некорректные строки и не доходят до хранилища
+func TestStatsDRejectsNonFinite(t *testing.T) {
+	ctx := context.Background()
+	storage := repository.NewMemStorage()
+
+	s := NewStatsD()
+	for _, line := range []string{
+		"x:NaN|g",
+		"x:+Inf|g",
+		"y:Inf|c",
+		"y:-Inf|c",
+		"z:NaN|ms",
+	} {
+		s.HandleLine(line)
+	}
+	assert.Equal(t, int64(5), s.Malformed())
+
+	require.NoError(t, s.Flush(ctx, storage))
+	_, err := storage.GetGauge(ctx, "x")
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+	_, err = storage.GetCounter(ctx, "y")
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+	_, err = storage.GetGauge(ctx, "z.mean")
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+}
+
+// Пакет из нескольких строк по UDP
+func TestStatsDServeUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewStatsD()
+	done := make(chan error, 1)
+	go func() { done <- ServeUDP(ctx, conn, s.HandleLine) }()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("a:1|c\nb:2|g\n"))
+	require.NoError(t, err)
+
+	storage := repository.NewMemStorage()
+	require.Eventually(t, func() bool {
+		require.NoError(t, s.Flush(context.Background(), storage))
+		_, err := storage.GetGauge(context.Background(), "b")
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	a, _ := storage.GetCounter(context.Background(), "a")
+	assert.Equal(t, int64(1), a)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,4 @@
+// Package metricspb — код, сгенерированный из proto/metrics.proto.
+package metricspb
+
+//go:generate protoc -I ../../proto --go_out=../.. --go_opt=module=github.com/KurepinVladimir/go-musthave-metrics-tpl.git --go-grpc_out=../.. --go-grpc_opt=module=github.com/KurepinVladimir/go-musthave-metrics-tpl.git metrics.proto
@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/cryptohelpers"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/handler"
 )
 
 func ValidateHashSHA256(key string) func(http.Handler) http.Handler {
@@ -29,7 +30,7 @@ func ValidateHashSHA256(key string) func(http.Handler) http.Handler {
 			// читаем тело (после gzip-мидлвари тут уже распаковано)
 			bodyBytes, err := io.ReadAll(r.Body)
 			if err != nil {
-				http.Error(w, "unable to read body", http.StatusInternalServerError)
+				handler.WriteError(w, http.StatusInternalServerError, handler.CodeInternal, "unable to read body")
 				return
 			}
 			// возвращаем тело в r.Body для последующих обработчиков
@@ -37,7 +38,7 @@ func ValidateHashSHA256(key string) func(http.Handler) http.Handler {
 
 			// сверяем HMAC от "сырых" данных (до сжатия)
 			if !cryptohelpers.Compare(bodyBytes, key, sentHash) {
-				http.Error(w, "invalid signature", http.StatusBadRequest)
+				handler.WriteError(w, http.StatusBadRequest, handler.CodeInvalidSignature, "invalid signature")
 				return
 			}
 
@@ -45,3 +46,23 @@ func ValidateHashSHA256(key string) func(http.Handler) http.Handler {
 		})
 	}
 }
+
+// RequireHashSHA256 — строгий вариант ValidateHashSHA256 для опасных операций:
+// без ключа на сервере маршрут закрыт (403), запрос без подписи отклоняется (401)
+func RequireHashSHA256(key string) func(http.Handler) http.Handler {
+	validate := ValidateHashSHA256(key)
+	return func(next http.Handler) http.Handler {
+		checked := validate(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key == "" {
+				handler.WriteError(w, http.StatusForbidden, handler.CodeForbidden, "signing key is not configured")
+				return
+			}
+			if r.Header.Get("HashSHA256") == "" {
+				handler.WriteError(w, http.StatusUnauthorized, handler.CodeUnauthorized, "signature required")
+				return
+			}
+			checked.ServeHTTP(w, r)
+		})
+	}
+}
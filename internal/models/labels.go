@@ -0,0 +1,192 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Labels — набор меток метрики. Метрика с одним ID, но разными метками — это разные серии.
+type Labels map[string]string
+
+// SeriesID возвращает ключ серии в нотации Prometheus: `HeapAlloc{host="a",region="eu"}`.
+// Метки сортируются по имени, у метрики без меток ключ совпадает с ID.
+func SeriesID(id string, labels Labels) string {
+	if len(labels) == 0 {
+		return id
+	}
+	var b strings.Builder
+	b.WriteString(id)
+	b.WriteString(labels.String())
+	return b.String()
+}
+
+// SeriesID возвращает ключ серии метрики с учётом меток
+func (m Metrics) SeriesID() string {
+	return SeriesID(m.ID, m.Labels)
+}
+
+// String возвращает метки в виде `{a="1",b="2"}`; для пустого набора — пустую строку
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(l[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// ParseSeriesID разбирает ключ серии, построенный SeriesID, обратно на ID и метки.
+// Строка без блока меток целиком считается ID.
+func ParseSeriesID(key string) (string, Labels) {
+	open := strings.IndexByte(key, '{')
+	if open < 0 || !strings.HasSuffix(key, "}") {
+		return key, nil
+	}
+	labels, err := parseLabelBlock(key[open+1 : len(key)-1])
+	if err != nil {
+		return key, nil
+	}
+	return key[:open], labels
+}
+
+// SeriesMetric собирает метрику из ключа серии: gauge со значением value или counter с приростом delta
+func SeriesMetric(key, mtype string, value float64, delta int64) Metrics {
+	id, labels := ParseSeriesID(key)
+	m := Metrics{ID: id, MType: mtype, Labels: labels}
+	if mtype == Counter {
+		m.Delta = &delta
+	} else {
+		m.Value = &value
+	}
+	return m
+}
+
+// ValidateID проверяет ID метрики: символы `{`, `}` и `"` зарезервированы за блоком меток ключа серии,
+// иначе ID вида `x{a="b"}` читался бы как серия x с меткой a и мог совпасть с чужой серией
+func ValidateID(id string) error {
+	if strings.ContainsAny(id, `{}"`) {
+		return fmt.Errorf("metric id %q must not contain '{', '}' or '\"'", id)
+	}
+	return nil
+}
+
+// ValidateLabels проверяет имена меток: [a-zA-Z_][a-zA-Z0-9_]*
+func ValidateLabels(labels Labels) error {
+	for name := range labels {
+		if !validLabelName(name) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	return nil
+}
+
+// ParseLabelFilter разбирает фильтр из параметров запроса вида `label=host=a`
+func ParseLabelFilter(values []string) (Labels, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	filter := make(Labels, len(values))
+	for _, v := range values {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok || !validLabelName(name) {
+			return nil, fmt.Errorf("invalid label filter %q", v)
+		}
+		filter[name] = value
+	}
+	return filter, nil
+}
+
+// Match сообщает, содержит ли набор меток все пары из filter
+func (l Labels) Match(filter Labels) bool {
+	for name, value := range filter {
+		if v, ok := l[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+func validLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+// parseLabelBlock разбирает содержимое `{...}` без фигурных скобок
+func parseLabelBlock(s string) (Labels, error) {
+	labels := make(Labels)
+	for len(s) > 0 {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 || eq+1 >= len(s) || s[eq+1] != '"' {
+			return nil, errors.New("malformed label block")
+		}
+		name := s[:eq]
+		s = s[eq+2:]
+
+		var value strings.Builder
+		closed := false
+		for i := 0; i < len(s); i++ {
+			c := s[i]
+			if c == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(s[i])
+				}
+				continue
+			}
+			if c == '"' {
+				s = s[i+1:]
+				closed = true
+				break
+			}
+			value.WriteByte(c)
+		}
+		if !closed {
+			return nil, errors.New("unterminated label value")
+		}
+		labels[name] = value.String()
+
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if s != "" {
+			return nil, errors.New("malformed label block")
+		}
+	}
+	return labels, nil
+}
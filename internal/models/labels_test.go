@@ -0,0 +1,65 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeriesIDRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     string
+		labels Labels
+		want   string
+	}{
+		{"no labels", "HeapAlloc", nil, "HeapAlloc"},
+		{"sorted labels", "HeapAlloc", Labels{"region": "eu", "host": "a"}, `HeapAlloc{host="a",region="eu"}`},
+		{"escaped value", "X", Labels{"path": `C:\tmp "x"` + "\n"}, `X{path="C:\\tmp \"x\"\n"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := SeriesID(tt.id, tt.labels)
+			assert.Equal(t, tt.want, key)
+
+			id, labels := ParseSeriesID(key)
+			assert.Equal(t, tt.id, id)
+			if len(tt.labels) == 0 {
+				assert.Empty(t, labels)
+			} else {
+				assert.Equal(t, tt.labels, labels)
+			}
+
+			g := SeriesMetric(key, Gauge, 1.5, 0)
+			assert.Equal(t, key, g.SeriesID())
+			assert.Equal(t, 1.5, *g.Value)
+			assert.Nil(t, g.Delta)
+			c := SeriesMetric(key, Counter, 0, 3)
+			assert.Equal(t, int64(3), *c.Delta)
+			assert.Nil(t, c.Value)
+		})
+	}
+}
+
+func TestParseLabelFilter(t *testing.T) {
+	filter, err := ParseLabelFilter([]string{"host=a", "env=prod=1"})
+	assert.NoError(t, err)
+	assert.Equal(t, Labels{"host": "a", "env": "prod=1"}, filter)
+
+	assert.True(t, Labels{"host": "a", "env": "prod=1", "x": "y"}.Match(filter))
+	assert.False(t, Labels{"host": "a"}.Match(filter))
+
+	_, err = ParseLabelFilter([]string{"1host=a"})
+	assert.Error(t, err)
+	_, err = ParseLabelFilter([]string{"host"})
+	assert.Error(t, err)
+}
+
+func TestValidateID(t *testing.T) {
+	assert.NoError(t, ValidateID("HeapAlloc"))
+	assert.NoError(t, ValidateID("disk.sda_read-bytes"))
+	for _, id := range []string{`x{a="b"}`, "x{", "x}", `x"`} {
+		assert.Error(t, ValidateID(id), id)
+	}
+}
@@ -16,4 +16,6 @@ type Metrics struct {
 	Delta *int64   `json:"delta,omitempty"`
 	Value *float64 `json:"value,omitempty"`
 	Hash  string   `json:"hash,omitempty"`
+	// Labels — необязательные метки; входят в идентичность серии вместе с ID
+	Labels Labels `json:"labels,omitempty"`
 }
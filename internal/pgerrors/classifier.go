@@ -1,7 +1,11 @@
 package pgerrors
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"errors"
+	"net"
 
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
@@ -26,3 +30,51 @@ func IsRetriable(err error) bool {
 	}
 	return false
 }
+
+// IsUnavailable: БД недоступна — ошибки соединения (см. IsRetriable), остановка сервера,
+// отказ в подключении и сетевые ошибки. Запрос можно повторить позже.
+// Истёкший дедлайн запроса сюда не относится: медленный запрос не означает, что БД недоступна.
+func IsUnavailable(err error) bool {
+	if IsRetriable(err) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == pgerrcode.AdminShutdown || pgErr.Code == pgerrcode.CrashShutdown
+	}
+	var connErr *pgconn.ConnectError
+	if errors.As(err, &connErr) {
+		return true
+	}
+	// context.DeadlineExceeded и таймауты pgconn реализуют net.Error — отсекаем их до проверки сетевых ошибок
+	if IsTimeout(err) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone)
+}
+
+// IsTimeout: запрос не уложился в дедлайн — клиентский (context, таймаут pgconn)
+// или серверный statement_timeout (57014).
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgerrcode.QueryCanceled
+}
+
+// IsTxRetriable: транзакция откатилась из-за конфликта с параллельной — сбой сериализации
+// или взаимная блокировка (Class 40). Её можно повторить целиком.
+func IsTxRetriable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	switch pgErr.Code {
+	case pgerrcode.SerializationFailure, // 40001
+		pgerrcode.DeadlockDetected: // 40P01
+		return true
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"context"
+	"sort"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+)
+
+// WriteBatch записывает пакет метрик: через UpdateBatch, если хранилище его поддерживает,
+// иначе поштучно до первой ошибки. Метрики без значения и неизвестных типов пропускаются.
+func WriteBatch(ctx context.Context, s Storage, batch []models.Metrics) error {
+	if bu, ok := s.(BatchUpdater); ok {
+		return bu.UpdateBatch(ctx, batch)
+	}
+	for _, m := range batch {
+		var err error
+		switch m.MType {
+		case models.Gauge:
+			if m.Value != nil {
+				err = s.UpdateGauge(ctx, m.SeriesID(), *m.Value)
+			}
+		case models.Counter:
+			if m.Delta != nil {
+				err = s.UpdateCounter(ctx, m.SeriesID(), *m.Delta)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seriesColumns — пакет метрик одного типа, разложенный по колонкам для unnest
+type seriesColumns[V float64 | int64] struct {
+	names  []string
+	labels []string // JSON для колонки labels
+	values []V
+}
+
+// aggregateBatch сводит повторы серий в пакете: у gauge остаётся последнее значение, приросты counter
+// складываются. Серии упорядочены по ключу — параллельные пакеты захватывают строки в одном порядке
+// и не блокируют друг друга намертво. Метрики без значения и неизвестных типов пропускаются.
+func aggregateBatch(batch []models.Metrics) (seriesColumns[float64], seriesColumns[int64]) {
+	gauges := make(map[string]float64)
+	counters := make(map[string]int64)
+	for _, m := range batch {
+		switch m.MType {
+		case models.Gauge:
+			if m.Value != nil {
+				gauges[m.SeriesID()] = *m.Value
+			}
+		case models.Counter:
+			if m.Delta != nil {
+				counters[m.SeriesID()] += *m.Delta
+			}
+		}
+	}
+	return toColumns(gauges), toColumns(counters)
+}
+
+func toColumns[V float64 | int64](series map[string]V) seriesColumns[V] {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	cols := seriesColumns[V]{
+		names:  make([]string, len(keys)),
+		labels: make([]string, len(keys)),
+		values: make([]V, len(keys)),
+	}
+	for i, key := range keys {
+		cols.names[i], cols.labels[i] = splitSeries(key)
+		cols.values[i] = series[key]
+	}
+	return cols
+}
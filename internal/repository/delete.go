@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"context"
+	"strings"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+)
+
+// Selector выбирает серии для удаления или сброса: одну серию по ключу (Series)
+// либо все серии, ID которых начинается с Prefix (с любыми метками).
+type Selector struct {
+	MType  string // gauge или counter; "" — оба типа
+	Series string
+	Prefix string
+}
+
+// Deleter — опциональное расширение Storage: удаление серий и сброс counter в ноль
+type Deleter interface {
+	// DeleteMetrics удаляет выбранные серии вместе с историей и возвращает их число
+	DeleteMetrics(ctx context.Context, sel Selector) (int, error)
+	// ResetCounters обнуляет выбранные counter (MType не учитывается) и возвращает их число
+	ResetCounters(ctx context.Context, sel Selector) (int, error)
+}
+
+// match сообщает, попадает ли ключ серии под селектор
+func (sel Selector) match(key string) bool {
+	if sel.Series != "" {
+		return key == sel.Series
+	}
+	id, _ := models.ParseSeriesID(key)
+	return strings.HasPrefix(id, sel.Prefix)
+}
+
+// types возвращает типы метрик, которые затрагивает селектор
+func (sel Selector) types() []string {
+	if sel.MType == "" {
+		return []string{models.Gauge, models.Counter}
+	}
+	return []string{sel.MType}
+}
@@ -0,0 +1,167 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrHistoryDisabled возвращается, если хранилище запущено без режима истории
+var ErrHistoryDisabled = errors.New("history is disabled")
+
+// Sample — одно значение метрики с меткой времени
+type Sample struct {
+	TS    time.Time `json:"ts"`
+	Value float64   `json:"value"`
+}
+
+// HistoryReader — опциональное расширение Storage: выборка истории метрики за интервал.
+// Для counter в истории хранится накопленное значение после каждого обновления.
+type HistoryReader interface {
+	QueryRange(ctx context.Context, mtype, name string, from, to time.Time, step time.Duration) ([]Sample, error)
+}
+
+// downsample прореживает отсортированные по времени сэмплы: в каждом окне
+// [from+k*step, from+(k+1)*step) остаётся последнее значение с меткой начала окна.
+// При step <= 0 сэмплы возвращаются как есть.
+func downsample(samples []Sample, from time.Time, step time.Duration) []Sample {
+	if step <= 0 || len(samples) == 0 {
+		return samples
+	}
+	out := make([]Sample, 0, len(samples))
+	lastBucket := int64(-1)
+	for _, s := range samples {
+		bucket := int64(s.TS.Sub(from) / step)
+		ts := from.Add(time.Duration(bucket) * step)
+		if bucket == lastBucket {
+			out[len(out)-1] = Sample{TS: ts, Value: s.Value}
+			continue
+		}
+		out = append(out, Sample{TS: ts, Value: s.Value})
+		lastBucket = bucket
+	}
+	return out
+}
+
+// sampleRing — кольцевой буфер фиксированной ёмкости; при переполнении вытесняет самые старые сэмплы
+type sampleRing struct {
+	buf   []Sample
+	start int // индекс самого старого сэмпла
+	n     int // число сэмплов в буфере
+}
+
+func newSampleRing(capacity int) *sampleRing {
+	return &sampleRing{buf: make([]Sample, capacity)}
+}
+
+func (r *sampleRing) push(s Sample) {
+	if len(r.buf) == 0 {
+		return
+	}
+	if r.n < len(r.buf) {
+		r.buf[(r.start+r.n)%len(r.buf)] = s
+		r.n++
+		return
+	}
+	r.buf[r.start] = s
+	r.start = (r.start + 1) % len(r.buf)
+}
+
+// between возвращает копию сэмплов с from <= ts <= to в порядке записи
+func (r *sampleRing) between(from, to time.Time) []Sample {
+	out := make([]Sample, 0)
+	for i := 0; i < r.n; i++ {
+		s := r.buf[(r.start+i)%len(r.buf)]
+		if s.TS.Before(from) || s.TS.After(to) {
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// dropBefore удаляет из начала буфера сэмплы с ts < cutoff и возвращает их
+func (r *sampleRing) dropBefore(cutoff time.Time) []Sample {
+	out := make([]Sample, 0)
+	for r.n > 0 && r.buf[r.start].TS.Before(cutoff) {
+		out = append(out, r.buf[r.start])
+		r.buf[r.start] = Sample{}
+		r.start = (r.start + 1) % len(r.buf)
+		r.n--
+	}
+	return out
+}
+
+// memSeries — история одной метрики: сырые сэмплы и агрегаты по шагам прореживания
+type memSeries struct {
+	raw     *sampleRing
+	rollups map[time.Duration][]Aggregate
+}
+
+// memHistory хранит историю по каждой метрике. Синхронизация — на стороне MemStorage.
+type memHistory struct {
+	capacity int
+	gauges   map[string]*memSeries
+	counters map[string]*memSeries
+}
+
+func newMemHistory(capacity int) *memHistory {
+	return &memHistory{
+		capacity: capacity,
+		gauges:   make(map[string]*memSeries),
+		counters: make(map[string]*memSeries),
+	}
+}
+
+func (h *memHistory) record(series map[string]*memSeries, name string, ts time.Time, value float64) {
+	sr, ok := series[name]
+	if !ok {
+		sr = &memSeries{raw: newSampleRing(h.capacity), rollups: make(map[time.Duration][]Aggregate)}
+		series[name] = sr
+	}
+	sr.raw.push(Sample{TS: ts, Value: value})
+}
+
+// between возвращает значения метрики за интервал: сначала агрегаты (их последнее значение), затем сырые сэмплы
+func (sr *memSeries) between(from, to time.Time) []Sample {
+	out := make([]Sample, 0)
+	for _, aggs := range sr.rollups {
+		for _, a := range aggs {
+			if a.TS.Before(from) || a.TS.After(to) {
+				continue
+			}
+			out = append(out, Sample{TS: a.TS, Value: a.Last})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].TS.Before(out[j].TS) })
+	return append(out, sr.raw.between(from, to)...)
+}
+
+// applyRetention сворачивает устаревшие сэмплы и агрегаты метрики по политике
+func (sr *memSeries) applyRetention(policy RetentionPolicy, now time.Time) {
+	old := sr.raw.dropBefore(policy.rawCutoff(now))
+	if len(policy.Levels) == 0 {
+		return
+	}
+
+	first := policy.Levels[0].Resolution
+	sr.rollups[first] = mergeAggregates(sr.rollups[first], aggregateSamples(old, first))
+
+	for i, lvl := range policy.Levels {
+		expired, rest := splitAggregates(sr.rollups[lvl.Resolution], policy.levelCutoff(i, now))
+		if len(rest) == 0 {
+			delete(sr.rollups, lvl.Resolution)
+		} else {
+			sr.rollups[lvl.Resolution] = rest
+		}
+		if i+1 < len(policy.Levels) && len(expired) > 0 {
+			next := policy.Levels[i+1].Resolution
+			sr.rollups[next] = mergeAggregates(sr.rollups[next], rollupAggregates(expired, next))
+		}
+	}
+}
+
+func (sr *memSeries) empty() bool {
+	return sr.raw.n == 0 && len(sr.rollups) == 0
+}
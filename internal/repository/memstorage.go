@@ -4,33 +4,48 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"io/fs"
+	"fmt"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
 )
 
-// Storage описывает поведение хранилища метрик
+// Storage описывает поведение хранилища метрик.
+// name — ключ серии: ID метрики, к которому при наличии меток добавлен их блок (models.SeriesID).
+// Get* возвращают ErrNotFound, если серии нет; недоступность backend'а оборачивается в ErrUnavailable.
 type Storage interface {
-	UpdateGauge(ctx context.Context, name string, value float64)
-	UpdateCounter(ctx context.Context, name string, value int64)
-	GetGauge(ctx context.Context, name string) (float64, bool)
-	GetCounter(ctx context.Context, name string) (int64, bool)
-	GetAllMetrics(ctx context.Context) (map[string]float64, map[string]int64)
+	UpdateGauge(ctx context.Context, name string, value float64) error
+	UpdateCounter(ctx context.Context, name string, value int64) error
+	GetGauge(ctx context.Context, name string) (float64, error)
+	GetCounter(ctx context.Context, name string) (int64, error)
+	GetAllMetrics(ctx context.Context) (map[string]float64, map[string]int64, error)
 }
 
+var (
+	// ErrNotFound — серии с таким ключом нет
+	ErrNotFound = errors.New("metric not found")
+	// ErrUnavailable — хранилище временно недоступно (нет соединения с БД и т.п.), запрос можно повторить
+	ErrUnavailable = errors.New("storage unavailable")
+	// ErrTimeout — запрос не уложился в дедлайн (statement_timeout и т.п.); хранилище при этом доступно
+	ErrTimeout = errors.New("storage timeout")
+)
+
 // Опциональное расширение: если реализация его поддержит — применим батч атомарно.
 type BatchUpdater interface {
 	UpdateBatch(ctx context.Context, batch []models.Metrics) error
 }
 
-// MemStorage реализует интерфейс Storage. хранилища в памяти
+// MemStorage реализует интерфейс Storage. хранилища в памяти.
+// Метрики с метками хранятся под ключом серии (см. models.SeriesID).
 type MemStorage struct {
 	mu       sync.RWMutex
 	gauges   map[string]float64
 	counters map[string]int64
+	history  *memHistory // nil — история не ведётся
+	saveMu   sync.Mutex  // снимки пишутся в файл по одному: PeriodicStore, admin-операции, остановка сервера
 }
 
 // NewMemStorage создаёт новое хранилище
@@ -41,35 +56,69 @@ func NewMemStorage() *MemStorage {
 	}
 }
 
-// UpdateGauge устанавливает значение метрики типа gauge
-func (s *MemStorage) UpdateGauge(_ context.Context, name string, value float64) {
+// EnableHistory включает запись истории: на каждую метрику хранится не более capacity последних сэмплов
+func (s *MemStorage) EnableHistory(capacity int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if capacity <= 0 {
+		s.history = nil
+		return
+	}
+	s.history = newMemHistory(capacity)
+}
+
+// setGauge и addCounter вызываются под s.mu.Lock и заодно пишут историю
+func (s *MemStorage) setGauge(name string, value float64, ts time.Time) {
 	s.gauges[name] = value
+	if s.history != nil {
+		s.history.record(s.history.gauges, name, ts, value)
+	}
+}
+
+func (s *MemStorage) addCounter(name string, delta int64, ts time.Time) {
+	s.counters[name] += delta
+	if s.history != nil {
+		s.history.record(s.history.counters, name, ts, float64(s.counters[name]))
+	}
+}
+
+// UpdateGauge устанавливает значение метрики типа gauge
+func (s *MemStorage) UpdateGauge(_ context.Context, name string, value float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setGauge(name, value, time.Now())
+	return nil
 }
 
 // UpdateCounter увеличивает значение метрики типа counter
-func (s *MemStorage) UpdateCounter(_ context.Context, name string, value int64) {
+func (s *MemStorage) UpdateCounter(_ context.Context, name string, value int64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.counters[name] += value
+	s.addCounter(name, value, time.Now())
+	return nil
 }
 
-func (s *MemStorage) GetGauge(_ context.Context, name string) (float64, bool) {
+func (s *MemStorage) GetGauge(_ context.Context, name string) (float64, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	val, ok := s.gauges[name]
-	return val, ok
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return val, nil
 }
 
-func (s *MemStorage) GetCounter(_ context.Context, name string) (int64, bool) {
+func (s *MemStorage) GetCounter(_ context.Context, name string) (int64, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	val, ok := s.counters[name]
-	return val, ok
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return val, nil
 }
 
-func (s *MemStorage) GetAllMetrics(_ context.Context) (map[string]float64, map[string]int64) {
+func (s *MemStorage) GetAllMetrics(_ context.Context) (map[string]float64, map[string]int64, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -82,37 +131,73 @@ func (s *MemStorage) GetAllMetrics(_ context.Context) (map[string]float64, map[s
 	for k, v := range s.counters {
 		counterCopy[k] = v
 	}
-	return gaugeCopy, counterCopy
+	return gaugeCopy, counterCopy, nil
 }
 
 func (s *MemStorage) SaveToFile(filename string) error {
+	// снимок берётся под saveMu: более поздний снимок не может оказаться в файле раньше более старого
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	data, err := s.snapshot()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, data)
+}
+
+// snapshot сериализует текущие метрики; ключ серии раскладывается обратно на ID и метки
+func (s *MemStorage) snapshot() ([]byte, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	var metrics []models.Metrics
-	for id, value := range s.gauges {
+	for key, value := range s.gauges {
 		val := value
+		id, labels := models.ParseSeriesID(key)
 		metrics = append(metrics, models.Metrics{
-			ID:    id,
-			MType: "gauge",
-			Value: &val,
+			ID:     id,
+			MType:  "gauge",
+			Value:  &val,
+			Labels: labels,
 		})
 	}
-	for id, delta := range s.counters {
+	for key, delta := range s.counters {
 		d := delta
+		id, labels := models.ParseSeriesID(key)
 		metrics = append(metrics, models.Metrics{
-			ID:    id,
-			MType: "counter",
-			Delta: &d,
+			ID:     id,
+			MType:  "counter",
+			Delta:  &d,
+			Labels: labels,
 		})
 	}
 
-	data, err := json.MarshalIndent(metrics, "", "  ")
+	return json.MarshalIndent(metrics, "", "  ")
+}
+
+// writeFileAtomic пишет data во временный файл рядом с filename и переименовывает его:
+// при сбое посреди записи в filename остаётся предыдущий снимок целиком
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
 	if err != nil {
 		return err
 	}
-
-	return os.WriteFile(filename, data, fs.FileMode(0666))
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
 }
 
 func (s *MemStorage) LoadFromFile(filename string) error {
@@ -136,11 +221,11 @@ func (s *MemStorage) LoadFromFile(filename string) error {
 		switch mtr.MType {
 		case "gauge":
 			if mtr.Value != nil {
-				s.gauges[mtr.ID] = *mtr.Value
+				s.gauges[mtr.SeriesID()] = *mtr.Value
 			}
 		case "counter":
 			if mtr.Delta != nil {
-				s.counters[mtr.ID] = *mtr.Delta
+				s.counters[mtr.SeriesID()] = *mtr.Delta
 			}
 		}
 	}
@@ -148,12 +233,19 @@ func (s *MemStorage) LoadFromFile(filename string) error {
 	return nil
 }
 
-func (s *MemStorage) PeriodicStore(filename string, interval time.Duration) {
+// PeriodicStore сохраняет снимок в файл каждые interval, пока не отменён ctx.
+// Финальное сохранение при остановке выполняет вызывающая сторона.
+func (s *MemStorage) PeriodicStore(ctx context.Context, filename string, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		_ = s.SaveToFile(filename)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_ = s.SaveToFile(filename)
+		}
 	}
 }
 
@@ -161,20 +253,117 @@ func (s *MemStorage) UpdateBatch(ctx context.Context, batch []models.Metrics) er
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	now := time.Now()
 	for _, met := range batch {
 		switch met.MType {
 		case "gauge":
 			if met.Value == nil {
 				continue
 			}
-			s.gauges[met.ID] = *met.Value
+			s.setGauge(met.SeriesID(), *met.Value, now)
 		case "counter":
 			if met.Delta == nil {
 				continue
 			}
 
-			s.counters[met.ID] += *met.Delta
+			s.addCounter(met.SeriesID(), *met.Delta, now)
+		}
+	}
+	return nil
+}
+
+// QueryRange возвращает историю метрики из кольцевого буфера
+func (s *MemStorage) QueryRange(_ context.Context, mtype, name string, from, to time.Time, step time.Duration) ([]Sample, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.history == nil {
+		return nil, ErrHistoryDisabled
+	}
+
+	var series map[string]*memSeries
+	switch mtype {
+	case "gauge":
+		series = s.history.gauges
+	case "counter":
+		series = s.history.counters
+	default:
+		return nil, fmt.Errorf("unknown metric type %q", mtype)
+	}
+
+	sr, ok := series[name]
+	if !ok {
+		return []Sample{}, nil
+	}
+	return downsample(sr.between(from, to), from, step), nil
+}
+
+// ApplyRetention сворачивает устаревшую историю в агрегаты и удаляет опустевшие серии
+func (s *MemStorage) ApplyRetention(_ context.Context, policy RetentionPolicy, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.history == nil {
+		return ErrHistoryDisabled
+	}
+
+	for _, series := range []map[string]*memSeries{s.history.gauges, s.history.counters} {
+		for name, sr := range series {
+			sr.applyRetention(policy, now)
+			if sr.empty() {
+				delete(series, name)
+			}
 		}
 	}
 	return nil
 }
+
+// DeleteMetrics удаляет выбранные серии и их историю
+func (s *MemStorage) DeleteMetrics(_ context.Context, sel Selector) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for _, mtype := range sel.types() {
+		switch mtype {
+		case models.Gauge:
+			deleted += deleteMatching(s.gauges, sel)
+			if s.history != nil {
+				deleteMatching(s.history.gauges, sel)
+			}
+		case models.Counter:
+			deleted += deleteMatching(s.counters, sel)
+			if s.history != nil {
+				deleteMatching(s.history.counters, sel)
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// ResetCounters обнуляет выбранные counter; в историю попадает сэмпл со значением 0
+func (s *MemStorage) ResetCounters(_ context.Context, sel Selector) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	reset := 0
+	for name, v := range s.counters {
+		if sel.match(name) {
+			s.addCounter(name, -v, now)
+			reset++
+		}
+	}
+	return reset, nil
+}
+
+func deleteMatching[V any](series map[string]V, sel Selector) int {
+	n := 0
+	for key := range series {
+		if sel.match(key) {
+			delete(series, key)
+			n++
+		}
+	}
+	return n
+}
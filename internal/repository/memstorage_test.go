@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Параллельные снимки не портят файл, не оставляют временных файлов, а последний снимок отражает удаление
+func TestSaveToFileConcurrent(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "metrics.json")
+
+	s := NewMemStorage()
+	for i := range 100 {
+		require.NoError(t, s.UpdateGauge(ctx, fmt.Sprintf("g%d", i), float64(i)))
+	}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.SaveToFile(filename))
+		}()
+	}
+	_, err := s.DeleteMetrics(ctx, Selector{Prefix: "g"})
+	require.NoError(t, err)
+	require.NoError(t, s.SaveToFile(filename))
+	wg.Wait()
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "temporary files are renamed or removed")
+
+	restored := NewMemStorage()
+	require.NoError(t, restored.LoadFromFile(filename))
+	gauges, _, err := restored.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	// снимок, взятый после удаления, может уступить только ещё более позднему
+	assert.Empty(t, gauges)
+}
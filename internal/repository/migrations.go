@@ -1,38 +1,160 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io/fs"
 
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/migrations"
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	_ "github.com/jackc/pgx/v5/stdlib" // golang-migrate работает через database/sql
 )
 
-func RunMigrations(dsn string) error {
+// migrationLockID — ключ pg_advisory_lock на время работы Migrator: реплики, стартующие одновременно,
+// применяют миграции по очереди, а не наперегонки. Драйвер postgres из golang-migrate берёт свою блокировку
+// в Lock(), но только на одну операцию; эта держится всю команду (status, down, force и т.д.)
+// и нужна вдобавок к ней, а не вместо.
+const migrationLockID int64 = 0x6d6574726963 // "metric"
+
+// MigrationStatus — состояние схемы: текущая версия, последняя из зашитых в бинарник и число непримёненных
+type MigrationStatus struct {
+	Version uint // 0 — миграции не применялись
+	Dirty   bool // миграция упала посередине, нужен Force
+	Latest  uint
+	Pending int
+}
+
+// Migrator применяет миграции из migrations.FS. Пока он открыт, держит advisory lock;
+// Close обязателен.
+type Migrator struct {
+	db   *sql.DB
+	conn *sql.Conn // сессия, которая держит advisory lock
+	src  source.Driver
+	m    *migrate.Migrate
+}
+
+// OpenMigrator подключается к БД и ждёт advisory lock; ожидание прерывается отменой ctx
+func OpenMigrator(ctx context.Context, dsn string) (*Migrator, error) {
 	db, err := sql.Open("pgx", dsn)
 	if err != nil {
-		return fmt.Errorf("failed to open DB for migration: %w", err)
+		return nil, fmt.Errorf("failed to open DB for migration: %w", err)
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect for migration: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		conn.Close()
+		db.Close()
+		return nil, fmt.Errorf("failed to take migration lock: %w", err)
 	}
-	defer db.Close()
 
-	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	mg := &Migrator{db: db, conn: conn}
+	if err := mg.init(); err != nil {
+		mg.Close()
+		return nil, err
+	}
+	return mg, nil
+}
+
+func (mg *Migrator) init() error {
+	src, err := iofs.New(migrations.FS, ".")
 	if err != nil {
-		return fmt.Errorf("failed to create postgres driver: %w", err)
+		return fmt.Errorf("failed to read embedded migrations: %w", err)
 	}
+	mg.src = src
 
-	m, err := migrate.NewWithDatabaseInstance(
-		"file://migrations", // путь к миграциям
-		"postgres",
-		driver,
-	)
+	driver, err := postgres.WithInstance(mg.db, &postgres.Config{})
+	if err != nil {
+		src.Close()
+		return fmt.Errorf("failed to create postgres driver: %w", err)
+	}
+	mg.m, err = migrate.NewWithInstance("iofs", src, "postgres", driver)
 	if err != nil {
+		// до появления mg.m источник и соединение драйвера закрываем сами
+		src.Close()
+		driver.Close()
 		return fmt.Errorf("failed to initialize migrate instance: %w", err)
 	}
+	return nil
+}
+
+// Close снимает advisory lock и закрывает соединения
+func (mg *Migrator) Close() error {
+	_, unlockErr := mg.conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+	errs := []error{unlockErr, mg.conn.Close()}
+	if mg.m != nil {
+		// закрывает и источник, и драйвер вместе с db
+		srcErr, dbErr := mg.m.Close()
+		errs = append(errs, srcErr, dbErr)
+	} else {
+		errs = append(errs, mg.db.Close())
+	}
+	return errors.Join(errs...)
+}
 
-	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
+// Up применяет все непримёненные миграции
+func (mg *Migrator) Up() error {
+	if err := mg.m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
 		return fmt.Errorf("migration failed: %w", err)
 	}
+	return nil
+}
+
+// Down откатывает n последних миграций
+func (mg *Migrator) Down(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("number of migrations to roll back must be positive, got %d", n)
+	}
+	if err := mg.m.Steps(-n); err != nil {
+		return fmt.Errorf("rollback failed: %w", err)
+	}
+	return nil
+}
 
+// Force записывает версию схемы без выполнения миграций и снимает признак dirty —
+// после того как упавшая миграция исправлена вручную
+func (mg *Migrator) Force(version int) error {
+	if err := mg.m.Force(version); err != nil {
+		return fmt.Errorf("force version %d: %w", version, err)
+	}
 	return nil
 }
+
+// Status возвращает версию схемы и число миграций, которые применит Up
+func (mg *Migrator) Status() (MigrationStatus, error) {
+	var st MigrationStatus
+	version, dirty, err := mg.m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return st, fmt.Errorf("read schema version: %w", err)
+	}
+	st.Version, st.Dirty = version, dirty
+
+	v, err := mg.src.First()
+	for err == nil {
+		st.Latest = v
+		if v > st.Version {
+			st.Pending++
+		}
+		v, err = mg.src.Next(v)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return st, fmt.Errorf("list migrations: %w", err)
+	}
+	return st, nil
+}
+
+// RunMigrations применяет все миграции под advisory lock — вызывается при старте сервера
+func RunMigrations(ctx context.Context, dsn string) error {
+	mg, err := OpenMigrator(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	return errors.Join(mg.Up(), mg.Close())
+}
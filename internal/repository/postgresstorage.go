@@ -2,149 +2,461 @@ package repository
 
 import (
 	"context"
-	"database/sql"
+	"encoding/json"
 	"errors"
 
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 
 	"fmt"
+	"strings"
 	"time"
 
-	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/pgerrors"
 	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/retry"
-	"go.uber.org/zap"
 )
 
+// pgxConn — методы пула pgx, которые использует PostgresStorage; в тестах подменяется фейком
+type pgxConn interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+}
+
+// PostgresStorage хранит метрики в PostgreSQL через пул pgx (см. NewPool)
 type PostgresStorage struct {
-	db *sql.DB
+	pool    pgxConn
+	history bool // писать ли сэмплы в gauge_samples/counter_samples
 }
 
-func NewPostgresStorage(db *sql.DB) *PostgresStorage {
+func NewPostgresStorage(pool *pgxpool.Pool) *PostgresStorage {
 	return &PostgresStorage{
-		db: db,
+		pool: pool,
+	}
+}
+
+// EnableHistory включает запись каждого обновления в таблицы сэмплов
+func (p *PostgresStorage) EnableHistory() {
+	p.history = true
+}
+
+const (
+	// $1 — ID метрики, $2 — значение, $3 — метки (JSONB)
+	upsertGaugeSQL = `
+		INSERT INTO gauge_metrics (name, value, labels)
+		VALUES ($1, $2, $3::JSONB)
+		ON CONFLICT (name, labels) DO UPDATE SET value = EXCLUDED.value
+	`
+	upsertCounterSQL = `
+		INSERT INTO counter_metrics (name, value, labels)
+		VALUES ($1, $2, $3::JSONB)
+		ON CONFLICT (name, labels) DO UPDATE SET value = counter_metrics.value + EXCLUDED.value
+	`
+	// то же самое + сэмпл в историю одним запросом; для counter пишем итоговое значение
+	upsertGaugeWithSampleSQL = `
+		WITH up AS (
+			INSERT INTO gauge_metrics (name, value, labels)
+			VALUES ($1, $2, $3::JSONB)
+			ON CONFLICT (name, labels) DO UPDATE SET value = EXCLUDED.value
+			RETURNING name, labels, value
+		)
+		INSERT INTO gauge_samples (name, labels, ts, value) SELECT name, labels, now(), value FROM up
+	`
+	upsertCounterWithSampleSQL = `
+		WITH up AS (
+			INSERT INTO counter_metrics (name, value, labels)
+			VALUES ($1, $2, $3::JSONB)
+			ON CONFLICT (name, labels) DO UPDATE SET value = counter_metrics.value + EXCLUDED.value
+			RETURNING name, labels, value
+		)
+		INSERT INTO counter_samples (name, labels, ts, value) SELECT name, labels, now(), value FROM up
+	`
+)
+
+func (p *PostgresStorage) gaugeSQL() string {
+	if p.history {
+		return upsertGaugeWithSampleSQL
+	}
+	return upsertGaugeSQL
+}
+
+func (p *PostgresStorage) counterSQL() string {
+	if p.history {
+		return upsertCounterWithSampleSQL
+	}
+	return upsertCounterSQL
+}
+
+// splitSeries раскладывает ключ серии на ID и метки в виде JSON для колонки labels
+func splitSeries(key string) (string, string) {
+	id, labels := models.ParseSeriesID(key)
+	return id, labelsJSON(labels)
+}
+
+func labelsJSON(labels models.Labels) string {
+	if len(labels) == 0 {
+		return "{}"
 	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// seriesKey собирает ключ серии из колонок name и labels
+func seriesKey(name string, labels []byte) string {
+	var l models.Labels
+	if len(labels) > 0 {
+		_ = json.Unmarshal(labels, &l)
+	}
+	return models.SeriesID(name, l)
 }
 
 var pgDelays = []time.Duration{time.Second, 3 * time.Second, 5 * time.Second}
 
 func (p *PostgresStorage) execWithRetry(ctx context.Context, query string, args ...any) error {
 	return retry.DoIf(ctx, pgDelays, func(ctx context.Context) error {
-		_, err := p.db.ExecContext(ctx, query, args...)
-		if err != nil {
-			return fmt.Errorf("%s: %w", "pg exec", err)
-		}
-		return nil
+		_, err := p.pool.Exec(ctx, query, args...)
+		return err
 	}, pgerrors.IsRetriable)
 }
 
-func (p *PostgresStorage) UpdateGauge(ctx context.Context, name string, value float64) {
-	if err := p.execWithRetry(ctx, `
-		INSERT INTO gauge_metrics (name, value)
-		VALUES ($1, $2)
-		ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value
-	`, name, value); err != nil {
-		logger.Log.Error("update gauge failed", zap.Error(err))
+// wrapErr приводит ошибку драйвера к ошибкам репозитория: нет строки — ErrNotFound,
+// нет соединения с БД — ErrUnavailable; исходная ошибка остаётся в цепочке
+func wrapErr(op string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, pgx.ErrNoRows):
+		return ErrNotFound
+	case pgerrors.IsUnavailable(err):
+		return fmt.Errorf("%s: %w: %w", op, ErrUnavailable, err)
+	case pgerrors.IsTimeout(err):
+		return fmt.Errorf("%s: %w: %w", op, ErrTimeout, err)
 	}
+	return fmt.Errorf("%s: %w", op, err)
 }
 
-func (p *PostgresStorage) UpdateCounter(ctx context.Context, name string, delta int64) {
-	if err := p.execWithRetry(ctx, `
-		INSERT INTO counter_metrics (name, value)
-		VALUES ($1, $2)
-		ON CONFLICT (name) DO UPDATE SET value = counter_metrics.value + EXCLUDED.value
-	`, name, delta); err != nil {
-		logger.Log.Error("update counter failed", zap.Error(err))
-	}
+func (p *PostgresStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
+	id, labels := splitSeries(name)
+	return wrapErr("update gauge", p.execWithRetry(ctx, p.gaugeSQL(), id, value, labels))
+}
+
+func (p *PostgresStorage) UpdateCounter(ctx context.Context, name string, delta int64) error {
+	id, labels := splitSeries(name)
+	return wrapErr("update counter", p.execWithRetry(ctx, p.counterSQL(), id, delta, labels))
 }
 
-func (p *PostgresStorage) GetGauge(ctx context.Context, name string) (float64, bool) {
+func (p *PostgresStorage) GetGauge(ctx context.Context, name string) (float64, error) {
 	var val float64
-	err := p.db.QueryRowContext(ctx, `SELECT value FROM gauge_metrics WHERE name = $1`, name).Scan(&val)
-	if errors.Is(err, sql.ErrNoRows) {
-		return 0, false
-	}
-	return val, err == nil
+	id, labels := splitSeries(name)
+	err := p.pool.QueryRow(ctx, `SELECT value FROM gauge_metrics WHERE name = $1 AND labels = $2::JSONB`, id, labels).Scan(&val)
+	return val, wrapErr("get gauge", err)
 }
 
-func (p *PostgresStorage) GetCounter(ctx context.Context, name string) (int64, bool) {
+func (p *PostgresStorage) GetCounter(ctx context.Context, name string) (int64, error) {
 	var val int64
-	err := p.db.QueryRowContext(ctx, `SELECT value FROM counter_metrics WHERE name = $1`, name).Scan(&val)
-	if errors.Is(err, sql.ErrNoRows) {
-		return 0, false
+	id, labels := splitSeries(name)
+	err := p.pool.QueryRow(ctx, `SELECT value FROM counter_metrics WHERE name = $1 AND labels = $2::JSONB`, id, labels).Scan(&val)
+	return val, wrapErr("get counter", err)
+}
+
+func (p *PostgresStorage) GetAllMetrics(ctx context.Context) (map[string]float64, map[string]int64, error) {
+	gauges, err := selectAll[float64](ctx, p.pool, "gauge_metrics")
+	if err != nil {
+		return nil, nil, err
+	}
+	counters, err := selectAll[int64](ctx, p.pool, "counter_metrics")
+	if err != nil {
+		return nil, nil, err
 	}
-	return val, err == nil
+	return gauges, counters, nil
 }
 
-func (p *PostgresStorage) GetAllMetrics(ctx context.Context) (map[string]float64, map[string]int64) {
-	gauges := make(map[string]float64)
-	counters := make(map[string]int64)
+// selectAll читает все серии таблицы метрик; ошибка чтения любой строки — ошибка всего запроса
+func selectAll[V float64 | int64](ctx context.Context, pool pgxConn, table string) (map[string]V, error) {
+	rows, err := pool.Query(ctx, `SELECT name, labels, value FROM `+table)
+	if err != nil {
+		return nil, wrapErr("select "+table, err)
+	}
+	defer rows.Close()
 
-	rows, err := p.db.QueryContext(ctx, `SELECT name, value FROM gauge_metrics`)
-	if err == nil {
-		defer rows.Close()
-		for rows.Next() {
-			var name string
-			var val float64
-			if err := rows.Scan(&name, &val); err == nil {
-				gauges[name] = val
-			}
-			if err := rows.Err(); err != nil {
-				return nil, nil
-			}
+	out := make(map[string]V)
+	for rows.Next() {
+		var name string
+		var labels []byte
+		var val V
+		if err := rows.Scan(&name, &labels, &val); err != nil {
+			return nil, wrapErr("scan "+table, err)
 		}
+		out[seriesKey(name, labels)] = val
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr("select "+table, err)
 	}
+	return out, nil
+}
 
-	rows, err = p.db.QueryContext(ctx, `SELECT name, value FROM counter_metrics`)
-	if err == nil {
-		defer rows.Close()
-		for rows.Next() {
-			var name string
-			var val int64
-			if err := rows.Scan(&name, &val); err == nil {
-				counters[name] = val
-			}
-			if err := rows.Err(); err != nil {
-				return nil, nil
-			}
+// UpdateBatch записывает пакет за один обмен с сервером: повторы сводятся в памяти (aggregateBatch),
+// каждый тип пишется одним upsert'ом из массивов. Оба запроса идут одним pgx.Batch —
+// в неявной транзакции, поэтому пакет применяется целиком или не применяется.
+// Транзакция, откатившаяся из-за deadlock или конфликта сериализации, повторяется целиком.
+func (p *PostgresStorage) UpdateBatch(ctx context.Context, batch []models.Metrics) error {
+	gauges, counters := aggregateBatch(batch)
+	if len(gauges.names) == 0 && len(counters.names) == 0 {
+		return nil
+	}
+
+	err := retry.DoIf(ctx, txDelays, func(ctx context.Context) error {
+		// pgx.Batch после отправки хранит описания выражений своего соединения — на каждую попытку новый
+		b := &pgx.Batch{}
+		if len(gauges.names) > 0 {
+			b.Queue(p.batchSQL(bulkGaugeSQL, "gauge_samples"), gauges.names, gauges.values, gauges.labels)
+		}
+		if len(counters.names) > 0 {
+			b.Queue(p.batchSQL(bulkCounterSQL, "counter_samples"), counters.names, counters.values, counters.labels)
+		}
+		return p.sendBatch(ctx, b)
+	}, pgerrors.IsTxRetriable)
+	return wrapErr("update batch", err)
+}
+
+// txDelays — паузы перед повтором транзакции: конфликт обычно разрешается за доли секунды.
+// Повторяется только транзакция, которую сервер гарантированно откатил (40001, 40P01): после обрыва соединения
+// она могла успеть зафиксироваться, и повтор прибавил бы приросты counter дважды.
+var txDelays = []time.Duration{50 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond}
+
+// sendBatch выполняет пакет и возвращает первую ошибку
+func (p *PostgresStorage) sendBatch(ctx context.Context, b *pgx.Batch) error {
+	br := p.pool.SendBatch(ctx, b)
+	for range b.Len() {
+		if _, err := br.Exec(); err != nil {
+			br.Close()
+			return err
 		}
 	}
+	return br.Close()
+}
 
-	return gauges, counters
+const (
+	// $1 — ID, $2 — значения, $3 — метки (JSON); строки вставляются в порядке массивов
+	bulkGaugeSQL = `
+		INSERT INTO gauge_metrics (name, value, labels)
+		SELECT name, value, labels::JSONB
+		FROM unnest($1::TEXT[], $2::DOUBLE PRECISION[], $3::TEXT[]) WITH ORDINALITY AS t(name, value, labels, ord)
+		ORDER BY ord
+		ON CONFLICT (name, labels) DO UPDATE SET value = EXCLUDED.value
+	`
+	bulkCounterSQL = `
+		INSERT INTO counter_metrics (name, value, labels)
+		SELECT name, value, labels::JSONB
+		FROM unnest($1::TEXT[], $2::BIGINT[], $3::TEXT[]) WITH ORDINALITY AS t(name, value, labels, ord)
+		ORDER BY ord
+		ON CONFLICT (name, labels) DO UPDATE SET value = counter_metrics.value + EXCLUDED.value
+	`
+)
+
+// batchSQL добавляет к upsert'у пакета запись сэмплов, если включена история
+func (p *PostgresStorage) batchSQL(upsert, samples string) string {
+	if !p.history {
+		return upsert
+	}
+	return `WITH up AS (` + upsert + ` RETURNING name, labels, value)
+		INSERT INTO ` + samples + ` (name, labels, ts, value) SELECT name, labels, now(), value FROM up`
 }
 
-func (p *PostgresStorage) UpdateBatch(ctx context.Context, batch []models.Metrics) error {
-	tx, err := p.db.BeginTx(ctx, &sql.TxOptions{})
+// QueryRange читает историю метрики из таблиц сэмплов
+func (p *PostgresStorage) QueryRange(ctx context.Context, mtype, name string, from, to time.Time, step time.Duration) ([]Sample, error) {
+	if !p.history {
+		return nil, ErrHistoryDisabled
+	}
+
+	var table string
+	switch mtype {
+	case "gauge":
+		table = "gauge_samples"
+	case "counter":
+		table = "counter_samples"
+	default:
+		return nil, fmt.Errorf("unknown metric type %q", mtype)
+	}
+
+	// свёрнутые агрегаты отдаём их последним значением, как и downsample
+	query := fmt.Sprintf(`
+		SELECT ts, last FROM metric_rollups
+		WHERE mtype = $4 AND name = $1 AND labels = $5::JSONB AND ts BETWEEN $2 AND $3
+		UNION ALL
+		SELECT ts, value::DOUBLE PRECISION FROM %s
+		WHERE name = $1 AND labels = $5::JSONB AND ts BETWEEN $2 AND $3
+		ORDER BY ts
+	`, table)
+
+	id, labels := splitSeries(name)
+	rows, err := p.pool.Query(ctx, query, id, from, to, mtype, labels)
+	if err != nil {
+		return nil, wrapErr("query samples", err)
+	}
+	defer rows.Close()
+
+	samples := make([]Sample, 0)
+	for rows.Next() {
+		var s Sample
+		if err := rows.Scan(&s.TS, &s.Value); err != nil {
+			return nil, fmt.Errorf("scan sample: %w", err)
+		}
+		samples = append(samples, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return downsample(samples, from, step), nil
+}
+
+// общий для всех уровней upsert агрегата: окна, свёрнутые в разные запуски, сливаются
+const rollupUpsertSQL = `
+	ON CONFLICT (mtype, name, labels, resolution, ts) DO UPDATE SET
+		min = LEAST(metric_rollups.min, EXCLUDED.min),
+		max = GREATEST(metric_rollups.max, EXCLUDED.max),
+		avg = (metric_rollups.avg * metric_rollups.count + EXCLUDED.avg * EXCLUDED.count)
+			/ (metric_rollups.count + EXCLUDED.count),
+		last = EXCLUDED.last,
+		count = metric_rollups.count + EXCLUDED.count
+`
+
+// ApplyRetention переносит устаревшие сэмплы в metric_rollups и прореживает агрегаты — всё в одной транзакции
+func (p *PostgresStorage) ApplyRetention(ctx context.Context, policy RetentionPolicy, now time.Time) error {
+	if !p.history {
+		return ErrHistoryDisabled
+	}
+
+	tx, err := p.pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer tx.Rollback(ctx)
 
-	for _, m := range batch {
-		switch m.MType {
-		case "gauge":
-			if m.Value == nil {
-				continue
+	rawCutoff := policy.rawCutoff(now)
+	for _, t := range []struct{ mtype, table string }{
+		{"gauge", "gauge_samples"},
+		{"counter", "counter_samples"},
+	} {
+		if len(policy.Levels) == 0 {
+			if _, err := tx.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE ts < $1`, t.table), rawCutoff); err != nil {
+				return fmt.Errorf("delete raw samples: %w", err)
 			}
-			_, err = tx.ExecContext(ctx, `
-				INSERT INTO gauge_metrics (name, value)
-				VALUES ($1, $2)
-				ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value
-			`, m.ID, *m.Value)
-		case "counter":
-			if m.Delta == nil {
-				continue
+			continue
+		}
+
+		res := int64(policy.Levels[0].Resolution / time.Second)
+		if _, err := tx.Exec(ctx, fmt.Sprintf(`
+			WITH moved AS (
+				DELETE FROM %s WHERE ts < $1 RETURNING name, labels, ts, value::DOUBLE PRECISION AS value
+			)
+			INSERT INTO metric_rollups (mtype, name, labels, resolution, ts, min, max, avg, last, count)
+			SELECT $2::TEXT, name, labels, $3::BIGINT,
+				to_timestamp(floor(extract(epoch FROM ts) / $3::BIGINT) * $3::BIGINT),
+				min(value), max(value), avg(value), (array_agg(value ORDER BY ts DESC))[1], count(*)
+			FROM moved
+			GROUP BY 2, 3, 5
+		`, t.table)+rollupUpsertSQL, rawCutoff, t.mtype, res); err != nil {
+			return fmt.Errorf("rollup raw samples: %w", err)
+		}
+	}
+
+	for i, lvl := range policy.Levels {
+		cutoff := policy.levelCutoff(i, now)
+		res := int64(lvl.Resolution / time.Second)
+
+		if i+1 == len(policy.Levels) {
+			if _, err := tx.Exec(ctx, `
+				DELETE FROM metric_rollups WHERE resolution = $1 AND ts < $2
+			`, res, cutoff); err != nil {
+				return fmt.Errorf("delete expired rollups: %w", err)
 			}
-			_, err = tx.ExecContext(ctx, `
-				INSERT INTO counter_metrics (name, value)
-				VALUES ($1, $2)
-				ON CONFLICT (name) DO UPDATE SET value = counter_metrics.value + EXCLUDED.value
-			`, m.ID, *m.Delta)
+			continue
 		}
+
+		next := int64(policy.Levels[i+1].Resolution / time.Second)
+		if _, err := tx.Exec(ctx, `
+			WITH moved AS (
+				DELETE FROM metric_rollups WHERE resolution = $1::BIGINT AND ts < $2
+				RETURNING mtype, name, labels, ts, min, max, avg, last, count
+			)
+			INSERT INTO metric_rollups (mtype, name, labels, resolution, ts, min, max, avg, last, count)
+			SELECT mtype, name, labels, $3::BIGINT,
+				to_timestamp(floor(extract(epoch FROM ts) / $3::BIGINT) * $3::BIGINT),
+				min(min), max(max), sum(avg * count) / sum(count),
+				(array_agg(last ORDER BY ts DESC))[1], sum(count)::BIGINT
+			FROM moved
+			GROUP BY 1, 2, 3, 5
+		`+rollupUpsertSQL, res, cutoff, next); err != nil {
+			return fmt.Errorf("rollup level %s: %w", lvl.Resolution, err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// selectorWhere — условие WHERE по селектору, параметры начинаются с $1
+func selectorWhere(sel Selector) (string, []any) {
+	if sel.Series != "" {
+		id, labels := splitSeries(sel.Series)
+		return `name = $1 AND labels = $2::JSONB`, []any{id, labels}
+	}
+	return `name LIKE $1 ESCAPE '\'`, []any{likePrefix(sel.Prefix)}
+}
+
+// likePrefix экранирует спецсимволы LIKE, чтобы префикс сравнивался буквально
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
+
+// DeleteMetrics удаляет серии вместе с сэмплами и агрегатами в одной транзакции
+func (p *PostgresStorage) DeleteMetrics(ctx context.Context, sel Selector) (int, error) {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return 0, wrapErr("begin delete", err)
+	}
+	defer tx.Rollback(ctx)
+
+	where, args := selectorWhere(sel)
+	deleted := 0
+	for _, mtype := range sel.types() {
+		tag, err := tx.Exec(ctx, fmt.Sprintf(`DELETE FROM %s_metrics WHERE %s`, mtype, where), args...)
 		if err != nil {
-			return err
+			return 0, wrapErr("delete "+mtype+" metrics", err)
+		}
+		deleted += int(tag.RowsAffected())
+
+		if _, err := tx.Exec(ctx, fmt.Sprintf(`DELETE FROM %s_samples WHERE %s`, mtype, where), args...); err != nil {
+			return 0, wrapErr("delete "+mtype+" samples", err)
 		}
+		rollupSQL := fmt.Sprintf(`DELETE FROM metric_rollups WHERE %s AND mtype = $%d`, where, len(args)+1)
+		if _, err := tx.Exec(ctx, rollupSQL, append(args, mtype)...); err != nil {
+			return 0, wrapErr("delete "+mtype+" rollups", err)
+		}
+	}
+	return deleted, wrapErr("commit delete", tx.Commit(ctx))
+}
+
+// ResetCounters обнуляет counter; при включённой истории пишет сэмпл со значением 0
+func (p *PostgresStorage) ResetCounters(ctx context.Context, sel Selector) (int, error) {
+	where, args := selectorWhere(sel)
+	query := `UPDATE counter_metrics SET value = 0 WHERE ` + where
+	if p.history {
+		query = `
+			WITH up AS (` + query + ` RETURNING name, labels, value)
+			INSERT INTO counter_samples (name, labels, ts, value) SELECT name, labels, now(), value FROM up
+		`
+	}
+	tag, err := p.pool.Exec(ctx, query, args...)
+	if err != nil {
+		return 0, wrapErr("reset counters", err)
 	}
-	return tx.Commit()
+	return int(tag.RowsAffected()), nil
 }
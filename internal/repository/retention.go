@@ -0,0 +1,193 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/logger"
+	"go.uber.org/zap"
+)
+
+// RollupLevel — уровень прореживания: агрегаты с шагом Resolution хранятся Keep от текущего момента,
+// после чего сворачиваются в следующий (более грубый) уровень или удаляются, если уровень последний.
+type RollupLevel struct {
+	Resolution time.Duration
+	Keep       time.Duration
+}
+
+// RetentionPolicy — политика хранения истории: сырые сэмплы живут Raw,
+// затем сворачиваются в агрегаты Levels[0], Levels[1] и т.д.
+type RetentionPolicy struct {
+	Raw    time.Duration
+	Levels []RollupLevel
+}
+
+// Aggregate — агрегат сэмплов за окно [TS, TS+resolution)
+type Aggregate struct {
+	TS    time.Time `json:"ts"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Avg   float64   `json:"avg"`
+	Last  float64   `json:"last"`
+	Count int64     `json:"count"`
+}
+
+// Retainer — опциональное расширение Storage: применение политики хранения истории
+type Retainer interface {
+	ApplyRetention(ctx context.Context, policy RetentionPolicy, now time.Time) error
+}
+
+// ParseRollupLevels разбирает описание уровней вида "1m:24h,1h:720h" (шаг:срок хранения).
+// Шаги должны возрастать, и каждый следующий должен быть кратен предыдущему.
+func ParseRollupLevels(spec string) ([]RollupLevel, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	var levels []RollupLevel
+	for _, part := range strings.Split(spec, ",") {
+		resStr, keepStr, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("rollup level %q: expected resolution:keep", part)
+		}
+		res, err := time.ParseDuration(resStr)
+		if err != nil {
+			return nil, fmt.Errorf("rollup level %q: %w", part, err)
+		}
+		keep, err := time.ParseDuration(keepStr)
+		if err != nil {
+			return nil, fmt.Errorf("rollup level %q: %w", part, err)
+		}
+		if res < time.Second || res%time.Second != 0 {
+			return nil, fmt.Errorf("rollup level %q: resolution must be a whole number of seconds", part)
+		}
+		if keep <= 0 {
+			return nil, fmt.Errorf("rollup level %q: keep must be positive", part)
+		}
+		if n := len(levels); n > 0 {
+			prev := levels[n-1].Resolution
+			if res <= prev || res%prev != 0 {
+				return nil, fmt.Errorf("rollup level %q: resolution must be a multiple of %s", part, prev)
+			}
+		}
+		levels = append(levels, RollupLevel{Resolution: res, Keep: keep})
+	}
+	return levels, nil
+}
+
+// rawCutoff — граница, старше которой сырые сэмплы уходят в первый уровень.
+// Выравниваем по шагу первого уровня, чтобы окно агрегата сворачивалось целиком.
+func (p RetentionPolicy) rawCutoff(now time.Time) time.Time {
+	cutoff := now.Add(-p.Raw)
+	if len(p.Levels) > 0 {
+		cutoff = alignTime(cutoff, p.Levels[0].Resolution)
+	}
+	return cutoff
+}
+
+// levelCutoff — граница, старше которой агрегаты уровня i сворачиваются дальше (или удаляются)
+func (p RetentionPolicy) levelCutoff(i int, now time.Time) time.Time {
+	cutoff := now.Add(-p.Levels[i].Keep)
+	if i+1 < len(p.Levels) {
+		cutoff = alignTime(cutoff, p.Levels[i+1].Resolution)
+	}
+	return cutoff
+}
+
+// alignTime округляет t вниз до кратного d от начала unix-эпохи (так же, как это делает SQL в PostgresStorage)
+func alignTime(t time.Time, d time.Duration) time.Time {
+	ns := t.UnixNano()
+	return time.Unix(0, ns-ns%int64(d))
+}
+
+// aggregateSamples сворачивает отсортированные по времени сэмплы в агрегаты с шагом res
+func aggregateSamples(samples []Sample, res time.Duration) []Aggregate {
+	out := make([]Aggregate, 0)
+	for _, s := range samples {
+		a := Aggregate{TS: alignTime(s.TS, res), Min: s.Value, Max: s.Value, Avg: s.Value, Last: s.Value, Count: 1}
+		if n := len(out); n > 0 && out[n-1].TS.Equal(a.TS) {
+			out[n-1].merge(a)
+			continue
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+// rollupAggregates сворачивает отсортированные агрегаты в более грубый шаг res
+func rollupAggregates(aggs []Aggregate, res time.Duration) []Aggregate {
+	out := make([]Aggregate, 0)
+	for _, a := range aggs {
+		a.TS = alignTime(a.TS, res)
+		if n := len(out); n > 0 && out[n-1].TS.Equal(a.TS) {
+			out[n-1].merge(a)
+			continue
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+// merge добавляет к агрегату более новый агрегат b
+func (a *Aggregate) merge(b Aggregate) {
+	if b.Min < a.Min {
+		a.Min = b.Min
+	}
+	if b.Max > a.Max {
+		a.Max = b.Max
+	}
+	total := a.Count + b.Count
+	if total > 0 {
+		a.Avg = (a.Avg*float64(a.Count) + b.Avg*float64(b.Count)) / float64(total)
+	}
+	a.Last = b.Last
+	a.Count = total
+}
+
+// mergeAggregates сливает два отсортированных списка агрегатов одного шага
+func mergeAggregates(dst, src []Aggregate) []Aggregate {
+	if len(src) == 0 {
+		return dst
+	}
+	byTS := make(map[int64]int, len(dst))
+	for i, a := range dst {
+		byTS[a.TS.UnixNano()] = i
+	}
+	for _, a := range src {
+		if i, ok := byTS[a.TS.UnixNano()]; ok {
+			dst[i].merge(a)
+			continue
+		}
+		byTS[a.TS.UnixNano()] = len(dst)
+		dst = append(dst, a)
+	}
+	sort.Slice(dst, func(i, j int) bool { return dst[i].TS.Before(dst[j].TS) })
+	return dst
+}
+
+// splitAggregates делит отсортированные агрегаты на старше cutoff и остальные
+func splitAggregates(aggs []Aggregate, cutoff time.Time) (old, rest []Aggregate) {
+	i := sort.Search(len(aggs), func(i int) bool { return !aggs[i].TS.Before(cutoff) })
+	return aggs[:i], aggs[i:]
+}
+
+// RunRetention периодически применяет политику хранения, пока не отменён ctx
+func RunRetention(ctx context.Context, r Retainer, policy RetentionPolicy, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.ApplyRetention(ctx, policy, time.Now()); err != nil {
+				logger.Log.Error("retention failed", zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRollupLevels(t *testing.T) {
+	levels, err := ParseRollupLevels("1m:24h, 1h:720h")
+	require.NoError(t, err)
+	assert.Equal(t, []RollupLevel{
+		{Resolution: time.Minute, Keep: 24 * time.Hour},
+		{Resolution: time.Hour, Keep: 720 * time.Hour},
+	}, levels)
+
+	levels, err = ParseRollupLevels("")
+	assert.NoError(t, err)
+	assert.Empty(t, levels)
+
+	for _, spec := range []string{"1m", "1m:abc", "500ms:1h", "1h:24h,1m:1h", "1m:1h,90s:2h", "1m:0s"} {
+		_, err := ParseRollupLevels(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestMemStorageApplyRetention(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemStorage()
+	s.EnableHistory(100)
+	s.UpdateGauge(ctx, "HeapAlloc", 1)
+	s.UpdateGauge(ctx, "HeapAlloc", 3)
+	s.UpdateCounter(ctx, "PollCount", 2)
+
+	policy := RetentionPolicy{
+		Raw: time.Hour,
+		Levels: []RollupLevel{
+			{Resolution: time.Minute, Keep: 24 * time.Hour},
+			{Resolution: time.Hour, Keep: 48 * time.Hour},
+		},
+	}
+	from := time.Now().Add(-time.Hour)
+
+	// пока сэмплы свежие — ничего не сворачивается
+	require.NoError(t, s.ApplyRetention(ctx, policy, time.Now()))
+	assert.Len(t, s.history.gauges["HeapAlloc"].raw.between(from, time.Now()), 2)
+
+	// через 2 часа сырые сэмплы уходят в минутные агрегаты
+	require.NoError(t, s.ApplyRetention(ctx, policy, time.Now().Add(2*time.Hour)))
+	sr := s.history.gauges["HeapAlloc"]
+	assert.Equal(t, 0, sr.raw.n)
+	aggs := sr.rollups[time.Minute]
+	require.NotEmpty(t, aggs)
+	last := aggs[len(aggs)-1]
+	assert.Equal(t, 3.0, last.Last)
+
+	var count int64
+	for _, a := range aggs {
+		count += a.Count
+	}
+	assert.Equal(t, int64(2), count)
+
+	got, err := s.QueryRange(ctx, "gauge", "HeapAlloc", from, time.Now().Add(time.Hour), 0)
+	require.NoError(t, err)
+	require.NotEmpty(t, got)
+	assert.Equal(t, 3.0, got[len(got)-1].Value)
+
+	// через 2 дня минутные агрегаты свёрнуты в часовые
+	require.NoError(t, s.ApplyRetention(ctx, policy, time.Now().Add(26*time.Hour)))
+	sr = s.history.gauges["HeapAlloc"]
+	assert.Empty(t, sr.rollups[time.Minute])
+	require.Len(t, sr.rollups[time.Hour], 1)
+	assert.Equal(t, 1.0, sr.rollups[time.Hour][0].Min)
+	assert.Equal(t, 3.0, sr.rollups[time.Hour][0].Max)
+	assert.Equal(t, 2.0, sr.rollups[time.Hour][0].Avg)
+
+	// после срока хранения последнего уровня серия удаляется целиком
+	require.NoError(t, s.ApplyRetention(ctx, policy, time.Now().Add(100*time.Hour)))
+	assert.NotContains(t, s.history.gauges, "HeapAlloc")
+	assert.NotContains(t, s.history.counters, "PollCount")
+}
+
+func TestMemStorageApplyRetentionDisabled(t *testing.T) {
+	s := NewMemStorage()
+	err := s.ApplyRetention(context.Background(), RetentionPolicy{Raw: time.Hour}, time.Now())
+	assert.ErrorIs(t, err, ErrHistoryDisabled)
+}
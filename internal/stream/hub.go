@@ -0,0 +1,148 @@
+// Package stream рассылает принятые обновления метрик подписчикам (GET /api/v1/stream).
+package stream
+
+import (
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+)
+
+// Event — принятое обновление метрики. Для counter Delta — прирост, Total — значение после обновления.
+type Event struct {
+	models.Metrics
+	Total *int64    `json:"total,omitempty"`
+	TS    time.Time `json:"ts"`
+}
+
+// Filter отбирает события для подписчика; пустые поля не ограничивают
+type Filter struct {
+	IDPatterns []string      // шаблоны path.Match, напр. "CPU*"; совпадение с любым
+	MType      string        // gauge или counter
+	Labels     models.Labels // серия должна содержать все пары
+}
+
+// Match сообщает, подходит ли событие под фильтр
+func (f Filter) Match(e Event) bool {
+	if f.MType != "" && f.MType != e.MType {
+		return false
+	}
+	if !e.Labels.Match(f.Labels) {
+		return false
+	}
+	if len(f.IDPatterns) == 0 {
+		return true
+	}
+	for _, p := range f.IDPatterns {
+		if ok, _ := path.Match(p, e.ID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscriber — подписка с ограниченным буфером. Если подписчик не успевает читать,
+// самые старые события вытесняются новыми, а их число копится в Dropped.
+type Subscriber struct {
+	filter  Filter
+	ch      chan Event
+	mu      sync.Mutex // сериализует вытеснение при параллельных Publish
+	dropped atomic.Int64
+}
+
+// Events — канал событий подписчика
+func (s *Subscriber) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped возвращает и обнуляет число вытесненных событий
+func (s *Subscriber) Dropped() int64 {
+	return s.dropped.Swap(0)
+}
+
+func (s *Subscriber) push(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		select {
+		case s.ch <- e:
+			return
+		default:
+		}
+		// буфер полон — вытесняем самое старое событие
+		select {
+		case <-s.ch:
+			s.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+// Hub раздаёт события всем подходящим подписчикам
+type Hub struct {
+	mu      sync.RWMutex
+	subs    map[*Subscriber]struct{}
+	bufSize int
+	active  atomic.Int64 // число подписчиков: без них публикация ничего не стоит
+	done    chan struct{}
+	closing sync.Once
+}
+
+// NewHub создаёт хаб с буфером bufSize событий на подписчика
+func NewHub(bufSize int) *Hub {
+	if bufSize < 1 {
+		bufSize = 1
+	}
+	return &Hub{
+		subs:    make(map[*Subscriber]struct{}),
+		bufSize: bufSize,
+		done:    make(chan struct{}),
+	}
+}
+
+// Subscribe регистрирует подписчика; после использования нужно вызвать Unsubscribe
+func (h *Hub) Subscribe(f Filter) *Subscriber {
+	s := &Subscriber{filter: f, ch: make(chan Event, h.bufSize)}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	h.active.Add(1)
+	return s
+}
+
+func (h *Hub) Unsubscribe(s *Subscriber) {
+	h.mu.Lock()
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		h.active.Add(-1)
+	}
+	h.mu.Unlock()
+}
+
+// Active сообщает, есть ли подписчики
+func (h *Hub) Active() bool {
+	return h.active.Load() > 0
+}
+
+// Publish отправляет событие подписчикам, не блокируясь на медленных
+func (h *Hub) Publish(e Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subs {
+		if s.filter.Match(e) {
+			s.push(e)
+		}
+	}
+}
+
+// Done закрывается при остановке хаба
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+// Close завершает все подписки: открытые потоки закрываются, чтобы не держать остановку сервера
+func (h *Hub) Close() {
+	h.closing.Do(func() { close(h.done) })
+}
@@ -0,0 +1,42 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gaugeEvent(id string, v float64) Event {
+	return Event{Metrics: models.Metrics{ID: id, MType: models.Gauge, Value: &v}}
+}
+
+func TestHubFiltersAndDropsOldest(t *testing.T) {
+	hub := NewHub(2)
+	cpu := hub.Subscribe(Filter{IDPatterns: []string{"CPU*"}, MType: models.Gauge})
+	all := hub.Subscribe(Filter{})
+	assert.True(t, hub.Active())
+
+	d := int64(1)
+	hub.Publish(gaugeEvent("CPUutilization1", 1))
+	hub.Publish(Event{Metrics: models.Metrics{ID: "CPUcount", MType: models.Counter, Delta: &d}})
+	hub.Publish(gaugeEvent("Alloc", 2))
+	hub.Publish(gaugeEvent("CPUutilization2", 3))
+
+	// под фильтр попали только gauge CPU*
+	require.Len(t, cpu.Events(), 2)
+	assert.Equal(t, "CPUutilization1", (<-cpu.Events()).ID)
+	assert.Equal(t, "CPUutilization2", (<-cpu.Events()).ID)
+	assert.Zero(t, cpu.Dropped())
+
+	// медленный подписчик: буфер на 2 события, два самых старых вытеснены
+	require.Len(t, all.Events(), 2)
+	assert.Equal(t, int64(2), all.Dropped())
+	assert.Equal(t, "Alloc", (<-all.Events()).ID)
+	assert.Equal(t, "CPUutilization2", (<-all.Events()).ID)
+
+	hub.Unsubscribe(cpu)
+	hub.Unsubscribe(all)
+	assert.False(t, hub.Active())
+}
@@ -0,0 +1,68 @@
+package stream
+
+import (
+	"context"
+	"time"
+
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/models"
+	"github.com/KurepinVladimir/go-musthave-metrics-tpl.git/internal/repository"
+)
+
+// PublishingStorage — обёртка над repository.Storage, которая после каждого обновления
+// публикует событие в Hub. Чтение проходит в хранилище без изменений.
+type PublishingStorage struct {
+	repository.Storage
+	hub *Hub
+}
+
+func NewPublishingStorage(s repository.Storage, hub *Hub) *PublishingStorage {
+	return &PublishingStorage{Storage: s, hub: hub}
+}
+
+// UpdateGauge и UpdateCounter публикуют событие только после успешной записи
+func (p *PublishingStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
+	if err := p.Storage.UpdateGauge(ctx, name, value); err != nil {
+		return err
+	}
+	if p.hub.Active() {
+		p.publish(ctx, models.SeriesMetric(name, models.Gauge, value, 0), time.Now())
+	}
+	return nil
+}
+
+func (p *PublishingStorage) UpdateCounter(ctx context.Context, name string, value int64) error {
+	if err := p.Storage.UpdateCounter(ctx, name, value); err != nil {
+		return err
+	}
+	if p.hub.Active() {
+		p.publish(ctx, models.SeriesMetric(name, models.Counter, 0, value), time.Now())
+	}
+	return nil
+}
+
+// UpdateBatch пишет пакет через UpdateBatch хранилища (или поштучно) и публикует его после успешной записи
+func (p *PublishingStorage) UpdateBatch(ctx context.Context, batch []models.Metrics) error {
+	if err := repository.WriteBatch(ctx, p.Storage, batch); err != nil {
+		return err
+	}
+	if !p.hub.Active() {
+		return nil
+	}
+	now := time.Now()
+	for _, m := range batch {
+		if (m.MType == models.Gauge && m.Value != nil) || (m.MType == models.Counter && m.Delta != nil) {
+			p.publish(ctx, m, now)
+		}
+	}
+	return nil
+}
+
+func (p *PublishingStorage) publish(ctx context.Context, m models.Metrics, ts time.Time) {
+	e := Event{Metrics: m, TS: ts}
+	if m.MType == models.Counter {
+		if total, err := p.Storage.GetCounter(ctx, m.SeriesID()); err == nil {
+			e.Total = &total
+		}
+	}
+	p.hub.Publish(e)
+}
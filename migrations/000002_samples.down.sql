@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS counter_samples;
+DROP TABLE IF EXISTS gauge_samples;
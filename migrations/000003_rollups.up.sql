@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS metric_rollups (
+    mtype TEXT NOT NULL,
+    name TEXT NOT NULL,
+    resolution BIGINT NOT NULL,
+    ts TIMESTAMPTZ NOT NULL,
+    min DOUBLE PRECISION NOT NULL,
+    max DOUBLE PRECISION NOT NULL,
+    avg DOUBLE PRECISION NOT NULL,
+    last DOUBLE PRECISION NOT NULL,
+    count BIGINT NOT NULL,
+    PRIMARY KEY (mtype, name, resolution, ts)
+);
@@ -0,0 +1,25 @@
+-- серии с метками не помещаются в схему без меток — удаляем их
+DELETE FROM metric_rollups WHERE labels <> '{}';
+ALTER TABLE metric_rollups DROP CONSTRAINT IF EXISTS metric_rollups_pkey;
+ALTER TABLE metric_rollups DROP COLUMN IF EXISTS labels;
+ALTER TABLE metric_rollups ADD PRIMARY KEY (mtype, name, resolution, ts);
+
+DELETE FROM counter_samples WHERE labels <> '{}';
+DROP INDEX IF EXISTS counter_samples_name_labels_ts_idx;
+ALTER TABLE counter_samples DROP COLUMN IF EXISTS labels;
+CREATE INDEX IF NOT EXISTS counter_samples_name_ts_idx ON counter_samples (name, ts);
+
+DELETE FROM gauge_samples WHERE labels <> '{}';
+DROP INDEX IF EXISTS gauge_samples_name_labels_ts_idx;
+ALTER TABLE gauge_samples DROP COLUMN IF EXISTS labels;
+CREATE INDEX IF NOT EXISTS gauge_samples_name_ts_idx ON gauge_samples (name, ts);
+
+DELETE FROM counter_metrics WHERE labels <> '{}';
+ALTER TABLE counter_metrics DROP CONSTRAINT IF EXISTS counter_metrics_pkey;
+ALTER TABLE counter_metrics DROP COLUMN IF EXISTS labels;
+ALTER TABLE counter_metrics ADD PRIMARY KEY (name);
+
+DELETE FROM gauge_metrics WHERE labels <> '{}';
+ALTER TABLE gauge_metrics DROP CONSTRAINT IF EXISTS gauge_metrics_pkey;
+ALTER TABLE gauge_metrics DROP COLUMN IF EXISTS labels;
+ALTER TABLE gauge_metrics ADD PRIMARY KEY (name);
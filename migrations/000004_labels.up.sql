@@ -0,0 +1,19 @@
+ALTER TABLE gauge_metrics ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE gauge_metrics DROP CONSTRAINT IF EXISTS gauge_metrics_pkey;
+ALTER TABLE gauge_metrics ADD PRIMARY KEY (name, labels);
+
+ALTER TABLE counter_metrics ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE counter_metrics DROP CONSTRAINT IF EXISTS counter_metrics_pkey;
+ALTER TABLE counter_metrics ADD PRIMARY KEY (name, labels);
+
+ALTER TABLE gauge_samples ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+DROP INDEX IF EXISTS gauge_samples_name_ts_idx;
+CREATE INDEX IF NOT EXISTS gauge_samples_name_labels_ts_idx ON gauge_samples (name, labels, ts);
+
+ALTER TABLE counter_samples ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+DROP INDEX IF EXISTS counter_samples_name_ts_idx;
+CREATE INDEX IF NOT EXISTS counter_samples_name_labels_ts_idx ON counter_samples (name, labels, ts);
+
+ALTER TABLE metric_rollups ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE metric_rollups DROP CONSTRAINT IF EXISTS metric_rollups_pkey;
+ALTER TABLE metric_rollups ADD PRIMARY KEY (mtype, name, labels, resolution, ts);
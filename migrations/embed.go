@@ -0,0 +1,10 @@
+// Package migrations содержит SQL-миграции схемы PostgreSQL, зашитые в бинарник:
+// сервер не зависит от рабочего каталога при запуске.
+package migrations
+
+import "embed"
+
+// FS — файлы миграций в формате golang-migrate: NNNNNN_name.up.sql и NNNNNN_name.down.sql
+//
+//go:embed *.sql
+var FS embed.FS